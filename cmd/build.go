@@ -19,9 +19,11 @@
 package cmd
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 
 	"github.com/cs3org/gaia/pkg/builder"
 	"github.com/spf13/cobra"
@@ -40,8 +42,37 @@ var buildFlags = struct {
 	LdFlags        string
 	Static         bool
 	StaticMusl     bool
+	File           string
+	Platforms      []string
+	LockFile       string
+	Locked         bool
+	WriteLock      bool
+	Offline        bool
+	SBOM           string
+	Provenance     bool
+	BuilderID      string
+	Reproducible   bool
+	NoCache        bool
+	Template       string
+	Targets        []string
+	RevaModule     string
+	CacheDir       string
+	CacheMaxSize   string
+	OCI            string
+	OCIBase        string
+	OCILabels      []string
+	OCIEntrypoint  []string
+	OCIRef         string
+	SignKey        string
+	GoVersion      string
+	ToolchainDir   string
+	CC             []string
+	Progress       string
+	Hooks          []string
 }{}
 
+const defaultOutput = "./revad"
+
 // buildCmd represents the build command
 var buildCmd = &cobra.Command{
 	Use:     "build",
@@ -50,33 +81,163 @@ var buildCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := cmd.Context()
 
+		version := "latest"
+		var cToolchains map[builder.Platform]builder.CToolchain
+		var hooks []builder.Hook
+		if buildFlags.File != "" {
+			recipe, err := builder.LoadRecipe(buildFlags.File)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitError)
+			}
+			applyRecipe(cmd, recipe)
+			if recipe.RevaVersion != "" {
+				version = recipe.RevaVersion
+			}
+			if cToolchains, err = recipeCToolchains(buildFlags.File, recipe); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitError)
+			}
+			if hooks, err = recipe.BuildHooks(); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitError)
+			}
+		}
+		// the toolchains given on the command line
+		// override the ones of the recipe
+		for _, s := range buildFlags.CC {
+			p, tc, err := builder.ParseCToolchain(s)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitUsage)
+			}
+			if cToolchains == nil {
+				cToolchains = make(map[builder.Platform]builder.CToolchain)
+			}
+			cToolchains[p] = tc
+		}
+		// the hooks given on the command line run
+		// after the ones of the recipe at the same point
+		for _, s := range buildFlags.Hooks {
+			h, err := builder.ParseHook(s)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitUsage)
+			}
+			hooks = append(hooks, h)
+		}
+
 		if buildFlags.OnlyPrepare && buildFlags.OnlyBuild {
 			fmt.Fprintln(os.Stderr, "Error: --only-prepare and --only-build cannot be used together")
-			os.Exit(1)
+			os.Exit(exitUsage)
+		}
+
+		if buildFlags.Locked && buildFlags.WriteLock {
+			fmt.Fprintln(os.Stderr, "Error: --locked and --write-lock cannot be used together")
+			os.Exit(exitUsage)
 		}
 
 		if buildFlags.Static && buildFlags.StaticMusl {
 			fmt.Fprintln(os.Stderr, "Error: --static and --static-musl cannot be used together")
-			os.Exit(1)
+			os.Exit(exitUsage)
+		}
+
+		cacheMaxSize, err := parseSize(buildFlags.CacheMaxSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
 		}
 
 		if buildFlags.OnlyPrepare {
 			buildFlags.LeaveWorkspace = true
 		}
 
+		if buildFlags.OnlyPrepare && buildFlags.OCI != "" {
+			fmt.Fprintln(os.Stderr, "Error: --oci needs the binaries, that --only-prepare does not build")
+			os.Exit(exitUsage)
+		}
+		ociLabels, err := builder.ParseOCILabels(buildFlags.OCILabels)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+
+		if buildFlags.GoVersion != "" {
+			if _, err := builder.ParseGoVersion(buildFlags.GoVersion); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitUsage)
+			}
+		}
+
+		var events builder.EventSink
+		if buildFlags.Progress != "" {
+			events, err = newProgress(buildFlags.Progress, os.Stderr)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitUsage)
+			}
+		}
+
+		var signKey ed25519.PrivateKey
+		if buildFlags.SignKey != "" {
+			signKey, err = builder.ReadPrivateKey(buildFlags.SignKey)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitUsage)
+			}
+		}
+
 		if buildFlags.OnlyBuild && buildFlags.Workspace == "" {
 			fmt.Fprintln(os.Stderr, "Error: asking to only build without specifying an existing workspace")
-			os.Exit(2)
+			os.Exit(exitUsage)
 		}
 
-		version := "latest"
 		if len(args) != 0 {
 			version = args[0]
 		}
 
-		plugins, replacement := parsePluginReplacement(buildFlags.With)
+		platforms := make([]builder.Platform, 0, len(buildFlags.Platforms))
+		for _, s := range buildFlags.Platforms {
+			p, err := builder.ParsePlatform(s)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitUsage)
+			}
+			platforms = append(platforms, p)
+		}
+
+		targets, err := builder.ParseTargets(buildFlags.Targets)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		// a single target is named after itself by default
+		if len(targets) == 1 && !cmd.Flags().Changed("output") && buildFlags.Output == defaultOutput {
+			buildFlags.Output = "./" + targets[0].Name
+		}
+
+		lockFile := buildFlags.LockFile
+		if lockFile == "" {
+			lockFile = builder.LockFileName
+			if buildFlags.File != "" {
+				lockFile = filepath.Join(filepath.Dir(buildFlags.File), builder.LockFileName)
+			}
+		}
+
+		var lock *builder.Lock
+		if buildFlags.Locked {
+			var err error
+			lock, err = builder.ReadLock(lockFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitError)
+			}
+		}
+
+		plugins, replacement := builder.ParsePluginReplacement(buildFlags.With)
 		builder := builder.Builder{
 			RevaVersion:    version,
+			RevaModule:     buildFlags.RevaModule,
 			Plugins:        plugins,
 			Replacement:    replacement,
 			Debug:          buildFlags.Debug,
@@ -88,66 +249,270 @@ var buildCmd = &cobra.Command{
 			LdFlags:        buildFlags.LdFlags,
 			Static:         buildFlags.Static,
 			StaticMusl:     buildFlags.StaticMusl,
+			CToolchains:    cToolchains,
+			Locked:         lock,
+			Offline:        buildFlags.Offline,
+			Provenance:     buildFlags.Provenance,
+			BuilderID:      buildFlags.BuilderID,
+			Reproducible:   buildFlags.Reproducible,
+			GoVersion:      buildFlags.GoVersion,
+			ToolchainDir:   buildFlags.ToolchainDir,
+			Template:       buildFlags.Template,
+			Targets:        targets,
+			SignKey:        signKey,
+			Events:         events,
+			Hooks:          hooks,
+		}
+		if len(platforms) == 1 {
+			builder.Platform = platforms[0]
 		}
 		defer builder.Close()
 
+		// the platforms left to build may be fewer
+		requested := platforms
+
+		// a workspace prepared or built in separate steps may have been
+		// changed in between, so that its binaries are not cached
+		if !buildFlags.NoCache && !buildFlags.OnlyPrepare && !buildFlags.OnlyBuild {
+			cache, err := openCache(buildFlags.CacheDir)
+			if err != nil {
+				fatal(err)
+			}
+			cache.MaxSize = cacheMaxSize
+			builder.Cache = cache
+
+			// the SBOM and the provenance need the prepared workspace
+			if buildFlags.SBOM == "" && !buildFlags.Provenance {
+				missing, err := fromCache(ctx, &builder, platforms)
+				if err != nil {
+					fatal(err)
+				}
+				if missing == nil {
+					writeOCI(ctx, &builder, requested, ociLabels)
+					return
+				}
+				platforms = missing
+			}
+		}
+
 		if !buildFlags.OnlyBuild {
 			err := builder.Prepare(ctx)
 			if err != nil {
-				log.Fatal().Err(err).Send()
+				fatal(err)
+			}
+
+			// the lock of a recipe is kept next to it, other
+			// builds only write one when asked to
+			writeLock := buildFlags.WriteLock || buildFlags.File != "" || cmd.Flags().Changed("lock-file")
+			if !buildFlags.Locked && writeLock {
+				lock, err := builder.Lock(ctx)
+				if err != nil {
+					fatal(err)
+				}
+				if err := lock.WriteFile(lockFile); err != nil {
+					fatal(err)
+				}
+				log.Info().Msgf("resolved modules written to %s", lockFile)
 			}
 		}
 
+		if buildFlags.SBOM != "" {
+			if err := writeSBOM(ctx, &builder, buildFlags.SBOM); err != nil {
+				fatal(err)
+			}
+			log.Info().Msgf("SBOM written to %s", buildFlags.SBOM)
+		}
+
 		if !buildFlags.OnlyPrepare {
-			err := builder.Build(ctx, buildFlags.Output)
-			if err != nil {
-				log.Fatal().Err(err).Send()
+			// with several platforms, even a single one left to build
+			// is named after its platform
+			if len(buildFlags.Platforms) > 1 {
+				artifacts, err := builder.BuildPlatforms(ctx, buildFlags.Output, platforms...)
+				if err != nil {
+					fatal(err)
+				}
+				for _, a := range artifacts {
+					log.Info().Msgf("built %s for %s", a.Path, a.Platform)
+				}
+			} else {
+				err := builder.Build(ctx, buildFlags.Output)
+				if err != nil {
+					fatal(err)
+				}
 			}
+			writeOCI(ctx, &builder, requested, ociLabels)
 		}
 	},
 }
 
-func parsePluginReplacement(l []string) ([]builder.Plugin, []builder.Replace) {
-	var plugins []builder.Plugin
-	var replacement []builder.Replace
-	for _, e := range l {
-		split := strings.SplitN(e, "=", 2)
-		p := parsePlugin(split[0])
-		plugins = append(plugins, p)
+// writeOCI writes the OCI image of the binaries built for
+// the platforms, if asked to.
+func writeOCI(ctx context.Context, b *builder.Builder, platforms []builder.Platform, labels map[string]string) {
+	if buildFlags.OCI == "" {
+		return
+	}
+	targets := b.Targets
+	if len(targets) == 0 {
+		targets = []builder.Target{builder.DefaultTarget}
+	}
+	var binaries []string
+	for _, t := range targets {
+		out := b.TargetOutput(buildFlags.Output, t)
+		if len(buildFlags.Platforms) <= 1 {
+			binaries = append(binaries, out)
+			continue
+		}
+		for _, p := range platforms {
+			binaries = append(binaries, builder.PlatformOutput(out, p))
+		}
+	}
+	opts := builder.OCIOptions{
+		Base:       buildFlags.OCIBase,
+		Entrypoint: buildFlags.OCIEntrypoint,
+		Labels:     labels,
+		Ref:        buildFlags.OCIRef,
+	}
+	if err := builder.WriteOCI(ctx, buildFlags.OCI, binaries, opts, log); err != nil {
+		fatal(err)
+	}
+	log.Info().Msgf("OCI image written to %s", buildFlags.OCI)
+}
+
+// fromCache copies the binaries found in the cache to their output.
+// It returns the platforms still to build, nil if none is left.
+func fromCache(ctx context.Context, b *builder.Builder, platforms []builder.Platform) ([]builder.Platform, error) {
+	targets := b.Targets
+	if len(targets) == 0 {
+		targets = []builder.Target{builder.DefaultTarget}
+	}
+	// a platform is built for all the targets at once
+	hitAll := func(p builder.Platform, suffix bool) (bool, error) {
+		for _, t := range targets {
+			out := b.TargetOutput(buildFlags.Output, t)
+			if suffix {
+				out = builder.PlatformOutput(out, p)
+			}
+			hit, err := b.FromCache(ctx, p, t, out)
+			if err != nil || !hit {
+				return false, err
+			}
+			log.Info().Msgf("%s taken from the cache", out)
+		}
+		return true, nil
+	}
 
-		if len(split) > 1 {
-			replacement = append(replacement, parseReplace(p, split[1]))
+	if len(platforms) <= 1 {
+		hit, err := hitAll(b.Platform, false)
+		if err != nil || hit {
+			return nil, err
 		}
+		return platforms, nil
 	}
-	return plugins, replacement
+
+	var missing []builder.Platform
+	for _, p := range platforms {
+		hit, err := hitAll(p, true)
+		if err != nil {
+			return nil, err
+		}
+		if !hit {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+func writeSBOM(ctx context.Context, b *builder.Builder, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := b.WriteSBOM(ctx, f); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
-func parsePlugin(s string) builder.Plugin {
-	var p builder.Plugin
-	split := strings.SplitN(s, "@", 2)
-	p.RepositoryPath = split[0]
-	if len(split) > 1 {
-		p.Version = split[1]
+// applyRecipe fills the build flags with the values of the recipe.
+// Flags explicitly set on the command line take precedence.
+func applyRecipe(cmd *cobra.Command, r *builder.Recipe) {
+	flags := cmd.Flags()
+	if !flags.Changed("with") {
+		buildFlags.With = r.With
+	}
+	if !flags.Changed("tags") {
+		buildFlags.BuildTags = r.Tags
+	}
+	if !flags.Changed("ldflags") {
+		buildFlags.LdFlags = r.LdFlags
+	}
+	if !flags.Changed("debug") {
+		buildFlags.Debug = r.Debug
+	}
+	if !flags.Changed("static") {
+		buildFlags.Static = r.Static
+	}
+	if !flags.Changed("static-musl") {
+		buildFlags.StaticMusl = r.StaticMusl
+	}
+	if !flags.Changed("vendor") {
+		buildFlags.Vendor = r.Vendor
+	}
+	if !flags.Changed("reproducible") {
+		buildFlags.Reproducible = r.Reproducible
+	}
+	if !flags.Changed("go-version") {
+		buildFlags.GoVersion = r.GoVersion
+	}
+	if !flags.Changed("reva-module") {
+		buildFlags.RevaModule = r.RevaModule
+	}
+	if !flags.Changed("template") && r.Template != "" {
+		buildFlags.Template = recipeRelative(buildFlags.File, r.Template)
+	}
+	if !flags.Changed("target") {
+		buildFlags.Targets = r.Targets
+	}
+	if !flags.Changed("platform") {
+		buildFlags.Platforms = r.Platforms
+	}
+	if !flags.Changed("output") && r.Output != "" {
+		buildFlags.Output = r.Output
+	}
+}
+
+// recipeCToolchains returns the C toolchains of the recipe,
+// with their sysroot relative to the recipe.
+func recipeCToolchains(file string, r *builder.Recipe) (map[builder.Platform]builder.CToolchain, error) {
+	toolchains, err := r.CToolchains()
+	if err != nil {
+		return nil, err
+	}
+	for p, tc := range toolchains {
+		if tc.Sysroot != "" {
+			tc.Sysroot = recipeRelative(file, tc.Sysroot)
+			toolchains[p] = tc
+		}
 	}
-	return p
+	return toolchains, nil
 }
 
-func parseReplace(p builder.Plugin, s string) builder.Replace {
-	var r builder.Replace
-	r.From = p.RepositoryPath
-	split := strings.SplitN(s, "@", 2)
-	r.To = split[0]
-	if len(split) > 1 {
-		r.ToVersion = split[1]
+// recipeRelative resolves a path of the recipe
+// relatively to the directory of the recipe.
+func recipeRelative(recipe, path string) string {
+	if filepath.IsAbs(path) {
+		return path
 	}
-	return r
+	return filepath.Join(filepath.Dir(recipe), path)
 }
 
 func init() {
 	rootCmd.AddCommand(buildCmd)
 
-	buildCmd.Flags().StringSliceVar(&buildFlags.With, "with", nil, "plugins to include in the build")
-	buildCmd.Flags().StringVarP(&buildFlags.Output, "output", "o", "./revad", "output file")
+	buildCmd.Flags().StringSliceVar(&buildFlags.With, "with", nil, "plugins to include in the build, as module[@version][=replacement], the version being exact, a query, a range (^1.2, ~1.4.0, \">=1.0 <2\") or compatible")
+	buildCmd.Flags().StringVar(&buildFlags.RevaModule, "reva-module", "", "module path of reva, e.g. of a fork (defaults to github.com/cs3org/reva with the major version of the requested reva, v3 if none)")
+	buildCmd.Flags().StringVarP(&buildFlags.Output, "output", "o", defaultOutput, "output file; with several targets, each binary is named after its target in the directory of the output")
 	buildCmd.Flags().BoolVarP(&buildFlags.Debug, "debug", "d", false, "compile with debug symbols")
 	buildCmd.Flags().BoolVarP(&buildFlags.LeaveWorkspace, "leave-workspace", "l", false, "leave temporary build work space after execution")
 	buildCmd.Flags().StringVarP(&buildFlags.Workspace, "workspace", "w", "", "path where to create the build files, leave empty for temp folder")
@@ -158,4 +523,31 @@ func init() {
 	buildCmd.Flags().StringVar(&buildFlags.LdFlags, "ldflags", "", "custom ldflags to inject (e.g., \"-extldflags=-static\")")
 	buildCmd.Flags().BoolVar(&buildFlags.Static, "static", false, "build statically linked binary (adds -extldflags=-static to ldflags)")
 	buildCmd.Flags().BoolVar(&buildFlags.StaticMusl, "static-musl", false, "build fully static binary using musl libc (requires musl-gcc, adds sqlite_omit_load_extension tag)")
+	buildCmd.Flags().StringArrayVar(&buildFlags.CC, "cc", nil, "C toolchain compiling the cgo code, as [os/arch=]<preset or compiler>, the presets being musl, zig and zig-gnu; without platform, for every platform")
+	buildCmd.Flags().StringVarP(&buildFlags.File, "file", "f", "", "build recipe (gaia.toml or gaia.yaml) to load; command line flags override its values")
+	buildCmd.Flags().StringSliceVar(&buildFlags.Platforms, "platform", nil, "comma separated list of os/arch platforms to build for; with more than one, the platform is appended to the output name (e.g. ./revad_linux_amd64)")
+	buildCmd.Flags().StringVar(&buildFlags.LockFile, "lock-file", "", "lock file recording the resolved modules (defaults to gaia.lock, next to the recipe if any)")
+	buildCmd.Flags().BoolVar(&buildFlags.Locked, "locked", false, "reproduce exactly the modules recorded in the lock file, failing on any drift")
+	buildCmd.Flags().BoolVar(&buildFlags.WriteLock, "write-lock", false, "write the resolved modules to the lock file, as always done with --file or --lock-file")
+	buildCmd.Flags().BoolVar(&buildFlags.Offline, "offline", false, "never access the network: use only the module cache and resolve the build metadata locally")
+	buildCmd.Flags().StringVar(&buildFlags.SBOM, "sbom", "", "write a CycloneDX SBOM of reva, the plugins and all their modules to this file")
+	buildCmd.Flags().BoolVar(&buildFlags.Provenance, "provenance", false, "write a SLSA provenance statement next to each binary (<output>.intoto.json)")
+	buildCmd.Flags().BoolVar(&buildFlags.Reproducible, "reproducible", false, "build reproducibly: take the build date from SOURCE_DATE_EPOCH or the reva commit, strip paths and VCS information and pin the toolchain")
+	buildCmd.Flags().StringVar(&buildFlags.GoVersion, "go-version", "", "go toolchain to build with, e.g. 1.22.5, taken from --toolchain-dir or the module cache when available, downloaded otherwise (default the installed go)")
+	buildCmd.Flags().StringVar(&buildFlags.ToolchainDir, "toolchain-dir", "", "directory holding go toolchains as go<version>, as installed by golang.org/dl (default ~/sdk)")
+	buildCmd.Flags().StringSliceVar(&buildFlags.Targets, "target", nil, "comma separated list of reva commands to build, as name[=package[:variables]] with the packages relative to reva (default revad, the package defaults to cmd/<name>)")
+	buildCmd.Flags().StringVar(&buildFlags.Template, "template", "", "custom template of the generated main.go, see the README for the data it receives")
+	buildCmd.Flags().BoolVar(&buildFlags.NoCache, "no-cache", false, "neither take the binary from the cache nor store it there")
+	buildCmd.Flags().StringVar(&buildFlags.CacheDir, "cache-dir", "", "directory of the binary cache (defaults to gaia/binaries in the user cache directory)")
+	buildCmd.Flags().StringVar(&buildFlags.CacheMaxSize, "cache-max-size", "10G", "remove the least recently used binaries from the cache beyond this size, 0 to keep them all")
+	buildCmd.Flags().StringVar(&buildFlags.OCI, "oci", "", "write an OCI image layout of the binaries to this directory, or tar if it ends with .tar, with an image per platform")
+	buildCmd.Flags().StringVar(&buildFlags.OCIBase, "oci-base", "scratch", "base of the OCI image: a local OCI image layout, directory or tar, optionally followed by :<ref>")
+	buildCmd.Flags().StringArrayVar(&buildFlags.OCILabels, "oci-label", nil, "label key=value added to the OCI image, besides the ones describing the build")
+	buildCmd.Flags().StringSliceVar(&buildFlags.OCIEntrypoint, "oci-entrypoint", nil, "entrypoint of the OCI image (default the binary in /usr/local/bin, the first target with several)")
+	buildCmd.Flags().StringVar(&buildFlags.OCIRef, "oci-ref", "", "name of the image in the OCI layout (default the reva version)")
+	buildCmd.Flags().StringVar(&buildFlags.SignKey, "sign-key", "", "ed25519 private key (PEM) to sign each binary with, writing <output>.sha256 and <output>.sig")
+	buildCmd.Flags().StringVar(&buildFlags.Progress, "progress", "", "report the stages of the build on the standard error, as text or json lines")
+	buildCmd.Flags().Lookup("progress").NoOptDefVal = "text"
+	buildCmd.Flags().StringArrayVar(&buildFlags.Hooks, "hook", nil, "shell command run in the workspace at a point of the build, as <pre|post>-<stage>=<command>, the stages being init, replace, get, tidy, vendor and compile")
+	buildCmd.Flags().StringVar(&buildFlags.BuilderID, "builder-id", builder.DefaultBuilderID, "identity of the builder recorded in the provenance")
 }
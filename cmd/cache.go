@@ -0,0 +1,176 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cs3org/gaia/pkg/builder"
+	"github.com/spf13/cobra"
+)
+
+var cacheFlags = struct {
+	Dir       string
+	OlderThan time.Duration
+	MaxSize   string
+}{}
+
+// cacheCmd represents the cache command
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the cache of built binaries",
+	Long:  "gaia build stores the binaries it builds in a local cache, keyed by the resolved inputs of the build, and reuses them when building the same inputs again.",
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:     "ls",
+	Short:   "List the binaries in the cache",
+	PreRunE: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, _ []string) {
+		cache, err := openCache(cacheFlags.Dir)
+		if err != nil {
+			fatal(err)
+		}
+		entries, err := cache.List()
+		if err != nil {
+			fatal(err)
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tREVA\tPLATFORM\tPLUGINS\tSIZE\tLAST USED")
+		var total int64
+		for _, e := range entries {
+			plugins := make([]string, 0, len(e.Inputs.Plugins))
+			for _, p := range e.Inputs.Plugins {
+				plugins = append(plugins, p.String())
+			}
+			if len(plugins) == 0 {
+				plugins = append(plugins, "-")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Key[:12], e.Inputs.RevaVersion, e.Inputs.Platform,
+				strings.Join(plugins, ","), formatSize(e.Size), e.LastUsed.Local().Format(time.DateTime))
+			total += e.Size
+		}
+		w.Flush()
+		fmt.Fprintf(cmd.OutOrStdout(), "%d binaries, %s in %s\n", len(entries), formatSize(total), cache.Dir)
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:     "prune",
+	Short:   "Remove the binaries not used recently",
+	Long:    "Remove the binaries not used for longer than --older-than, then the least recently used ones until the cache fits in --max-size.",
+	PreRunE: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, _ []string) {
+		maxSize, err := parseSize(cacheFlags.MaxSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		cache, err := openCache(cacheFlags.Dir)
+		if err != nil {
+			fatal(err)
+		}
+		removed, err := cache.Prune(cacheFlags.OlderThan, maxSize)
+		if err != nil {
+			fatal(err)
+		}
+		var freed int64
+		for _, e := range removed {
+			freed += e.Size
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "removed %d binaries, %s freed\n", len(removed), formatSize(freed))
+	},
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:     "clear",
+	Short:   "Remove all the binaries from the cache",
+	PreRunE: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, _ []string) {
+		cache, err := openCache(cacheFlags.Dir)
+		if err != nil {
+			fatal(err)
+		}
+		if err := cache.Clear(); err != nil {
+			fatal(err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "cleared %s\n", cache.Dir)
+	},
+}
+
+// openCache returns the binary cache in dir,
+// or in the default location if empty.
+func openCache(dir string) (*builder.Cache, error) {
+	if dir == "" {
+		var err error
+		if dir, err = builder.DefaultCacheDir(); err != nil {
+			return nil, fmt.Errorf("error locating the cache: %w", err)
+		}
+	}
+	return &builder.Cache{Dir: dir}, nil
+}
+
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+func formatSize(n int64) string {
+	f := float64(n)
+	unit := 0
+	for f >= 1024 && unit < len(sizeUnits)-1 {
+		f /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", f, sizeUnits[unit])
+}
+
+// parseSize parses a size in bytes, optionally followed
+// by one of the K, M, G or T binary multipliers.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := int64(1)
+	if i := strings.IndexAny(num, "KMGT"); i != -1 && i == len(num)-1 {
+		mult = 1 << (10 * (strings.IndexByte("KMGT", num[i]) + 1))
+		num = num[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q: expected a number of bytes, optionally followed by K, M, G or T", s)
+	}
+	return n * mult, nil
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheLsCmd, cachePruneCmd, cacheClearCmd)
+
+	cacheCmd.PersistentFlags().StringVar(&cacheFlags.Dir, "cache-dir", "", "directory of the binary cache (defaults to gaia/binaries in the user cache directory)")
+	cachePruneCmd.Flags().DurationVar(&cacheFlags.OlderThan, "older-than", 30*24*time.Hour, "remove the binaries not used for longer than this, 0 to keep them")
+	cachePruneCmd.Flags().StringVar(&cacheFlags.MaxSize, "max-size", "", "then remove the least recently used binaries until the cache fits in this size (e.g. 10G)")
+}
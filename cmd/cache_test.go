@@ -0,0 +1,80 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "1K", want: 1 << 10},
+		{in: "1k", want: 1 << 10},
+		{in: "1KB", want: 1 << 10},
+		{in: "1KiB", want: 1 << 10},
+		{in: "500M", want: 500 << 20},
+		{in: "10G", want: 10 << 30},
+		{in: "10 G", want: 10 << 30},
+		{in: "2T", want: 2 << 40},
+		{in: "-1G", wantErr: true},
+		{in: "1.5G", wantErr: true},
+		{in: "G", wantErr: true},
+		{in: "10P", wantErr: true},
+		{in: "1GK", wantErr: true},
+		{in: "ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize(%q) error = %v, want error %t", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{500 << 20, "500.0 MiB"},
+		{10 << 30, "10.0 GiB"},
+		{3 << 40, "3.0 TiB"},
+		{2048 << 40, "2048.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.in); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cs3org/gaia/pkg/builder"
+)
+
+// exit codes of gaia, so that scripts can tell
+// why a build failed
+const (
+	exitError             = 1
+	exitUsage             = 2
+	exitToolchainNotFound = 3
+	exitVersionNotFound   = 4
+	exitModuleFetch       = 5
+	exitCompile           = 6
+	exitNotReproducible   = 7
+	exitIncompatible      = 8
+	exitBadSignature      = 9
+	exitLockDrift         = 10
+)
+
+func exitCode(err error) int {
+	var (
+		fetchErr   *builder.ModuleFetchError
+		compileErr *builder.CompileError
+	)
+	switch {
+	case errors.Is(err, builder.ErrToolchainNotFound):
+		return exitToolchainNotFound
+	case errors.Is(err, builder.ErrBadSignature):
+		return exitBadSignature
+	case errors.Is(err, builder.ErrLockDrift):
+		return exitLockDrift
+	case errors.Is(err, builder.ErrIncompatiblePlugins):
+		return exitIncompatible
+	case errors.Is(err, builder.ErrVersionNotFound):
+		return exitVersionNotFound
+	case errors.As(err, &fetchErr):
+		return exitModuleFetch
+	case errors.As(err, &compileErr):
+		return exitCompile
+	default:
+		return exitError
+	}
+}
+
+// fatal logs the error and exits with the code matching it.
+// When the go toolchain output could be classified, a summary
+// of the problems is printed as well.
+func fatal(err error) {
+	log.Error().Err(err).Send()
+	if diags := builder.Diagnostics(err); len(diags) != 0 {
+		fmt.Fprintln(os.Stderr, "\nThe build failed because of:")
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, "  -", d)
+		}
+	}
+	os.Exit(exitCode(err))
+}
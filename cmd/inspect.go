@@ -0,0 +1,134 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cs3org/gaia/pkg/builder"
+	"github.com/spf13/cobra"
+)
+
+var inspectFlags = struct {
+	Format  string
+	Offline bool
+}{}
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:     "inspect <revad>",
+	Short:   "Show how a revad binary was built",
+	Long:    "Decode the build information of a revad binary built by gaia, and print the gaia build command or recipe rebuilding it.",
+	PreRunE: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		info, err := builder.Inspect(cmd.Context(), args[0], inspectFlags.Offline, log)
+		if err != nil {
+			fatal(err)
+		}
+
+		out := cmd.OutOrStdout()
+		switch inspectFlags.Format {
+		case "text":
+			printBinaryInfo(out, args[0], info)
+		case "json":
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(info)
+		case string(builder.RecipeTOML), string(builder.RecipeYAML):
+			err = info.Recipe().Encode(out, builder.RecipeFormat(inspectFlags.Format))
+		default:
+			fmt.Fprintf(os.Stderr, "Error: unknown format %q: expected text, json, toml or yaml\n", inspectFlags.Format)
+			os.Exit(exitUsage)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	},
+}
+
+func printBinaryInfo(w io.Writer, path string, info *builder.BinaryInfo) {
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+
+	reva := info.RevaVersion
+	if info.RevaReplace != nil {
+		reva += " (" + info.RevaReplace.String() + ")"
+	}
+	fmt.Fprintf(w, "binary:      %s\n", path)
+	if info.Target != nil {
+		fmt.Fprintf(w, "target:      %s\n", info.Target)
+	}
+	fmt.Fprintf(w, "reva:        %s\n", reva)
+	fmt.Fprintf(w, "commit:      %s\n", unknown(info.GitCommit))
+	fmt.Fprintf(w, "go version:  %s\n", info.GoVersion)
+	fmt.Fprintf(w, "build date:  %s\n", unknown(info.BuildDate))
+	fmt.Fprintf(w, "platform:    %s\n", info.Platform)
+	if len(info.Tags) != 0 {
+		fmt.Fprintf(w, "tags:        %s\n", strings.Join(info.Tags, ","))
+	}
+	if info.LdFlags != "" {
+		fmt.Fprintf(w, "ldflags:     %s\n", info.LdFlags)
+	}
+	if info.Debug || info.Static || info.StaticMusl {
+		var opts []string
+		for _, o := range []struct {
+			set  bool
+			name string
+		}{{info.Debug, "debug"}, {info.Static, "static"}, {info.StaticMusl, "static-musl"}} {
+			if o.set {
+				opts = append(opts, o.name)
+			}
+		}
+		fmt.Fprintf(w, "options:     %s\n", strings.Join(opts, ", "))
+	}
+
+	fmt.Fprintln(w, "plugins:")
+	if len(info.Plugins) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, p := range info.Plugins {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	if len(info.Replacement) != 0 {
+		fmt.Fprintln(w, "replacements:")
+		for _, r := range info.Replacement {
+			fmt.Fprintf(w, "  %s\n", r)
+		}
+	}
+	for _, warn := range info.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warn)
+	}
+
+	fmt.Fprintf(w, "\nto rebuild it:\n  %s\n", info.Command())
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().StringVar(&inspectFlags.Format, "format", "text", "output format: text, json, or the recipe as toml or yaml")
+	inspectCmd.Flags().BoolVar(&inspectFlags.Offline, "offline", false, "never access the network: use only the module cache to tell the plugins apart")
+}
@@ -0,0 +1,78 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cs3org/gaia/pkg/builder"
+	"github.com/spf13/cobra"
+)
+
+var packageFlags = struct {
+	Format     string
+	Output     string
+	Name       string
+	Maintainer string
+	Config     string
+	ConfigPath string
+	Offline    bool
+}{}
+
+// packageCmd represents the package command
+var packageCmd = &cobra.Command{
+	Use:     "package <revad>",
+	Short:   "Package a binary built by gaia as a tar.gz, deb or rpm",
+	Long:    "Package a binary built by gaia, together with a systemd unit, its configuration directory and the licenses of reva and of the plugins, versioned after the reva it was built from.",
+	PreRunE: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		format, err := builder.ParsePackageFormat(packageFlags.Format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		opts := builder.PackageOptions{
+			Format:     format,
+			Name:       packageFlags.Name,
+			Maintainer: packageFlags.Maintainer,
+			Config:     packageFlags.Config,
+			ConfigPath: packageFlags.ConfigPath,
+			Offline:    packageFlags.Offline,
+			Log:        log,
+		}
+		output, err := builder.Package(cmd.Context(), args[0], packageFlags.Output, opts)
+		if err != nil {
+			fatal(err)
+		}
+		log.Info().Msgf("package written to %s", output)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(packageCmd)
+
+	packageCmd.Flags().StringVar(&packageFlags.Format, "format", string(builder.PackageTarGz), "format of the package: tar.gz, deb or rpm")
+	packageCmd.Flags().StringVarP(&packageFlags.Output, "output", "o", "", "package file (defaults to the conventional name of the package in the current directory)")
+	packageCmd.Flags().StringVar(&packageFlags.Name, "name", "", "name of the package (defaults to the name of the binary target, e.g. revad)")
+	packageCmd.Flags().StringVar(&packageFlags.Maintainer, "maintainer", "", "maintainer of the package, as Name <email>, required for deb")
+	packageCmd.Flags().StringVar(&packageFlags.Config, "config", "", "configuration file to install at --config-path, kept on upgrades when changed locally")
+	packageCmd.Flags().StringVar(&packageFlags.ConfigPath, "config-path", builder.DefaultConfigPath, "configuration file revad is started with by the systemd unit")
+	packageCmd.Flags().BoolVar(&packageFlags.Offline, "offline", false, "never access the network: only bundle the licenses of the modules in the module cache")
+}
@@ -0,0 +1,79 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cs3org/gaia/pkg/builder"
+)
+
+// newProgress returns the sink rendering the events of the
+// build to w, as text for humans or as JSON lines.
+func newProgress(format string, w io.Writer) (builder.EventSink, error) {
+	var mu sync.Mutex
+	switch format {
+	case "text":
+		return builder.EventSinkFunc(func(e builder.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			printEvent(w, e)
+		}), nil
+	case "json":
+		enc := json.NewEncoder(w)
+		return builder.EventSinkFunc(func(e builder.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			_ = enc.Encode(e)
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown progress format %q: expected text or json", format)
+	}
+}
+
+func printEvent(w io.Writer, e builder.Event) {
+	stage := string(e.Stage)
+	if e.Stage == builder.StageCompile {
+		stage += " " + e.Target + " for " + e.Platform
+	}
+	switch e.Type {
+	case builder.EventStageStarted:
+		fmt.Fprintf(w, "==> %s\n", stage)
+	case builder.EventStageFinished:
+		if e.Error != "" {
+			fmt.Fprintf(w, "==> %s failed after %s\n", stage, e.Duration.Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(w, "==> %s done in %s\n", stage, e.Duration.Round(time.Millisecond))
+		}
+	case builder.EventFetchStarted:
+		fmt.Fprintf(w, "    [%d/%d] fetching %s\n", e.Index, e.Total, e.Plugin)
+	case builder.EventFetchFinished:
+		if e.Error != "" {
+			fmt.Fprintf(w, "    [%d/%d] failed to fetch %s\n", e.Index, e.Total, e.Plugin)
+		} else {
+			fmt.Fprintf(w, "    [%d/%d] fetched %s in %s\n", e.Index, e.Total, e.Plugin, e.Duration.Round(time.Millisecond))
+		}
+	case builder.EventOutput:
+		fmt.Fprintf(w, "    | %s\n", e.Line)
+	}
+}
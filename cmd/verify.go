@@ -0,0 +1,62 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cs3org/gaia/pkg/builder"
+	"github.com/spf13/cobra"
+)
+
+var verifyFlags = struct {
+	Pub       string
+	Signature string
+}{}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:     "verify <revad>",
+	Short:   "Check the signature of a binary built by gaia",
+	Long:    "Check that a binary was signed with the private key matching the public one, and that it matches its checksum file if there is one next to it.",
+	PreRunE: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if verifyFlags.Pub == "" {
+			fmt.Fprintln(os.Stderr, "Error: the public key to verify with is required (--pub)")
+			os.Exit(exitUsage)
+		}
+		pub, err := builder.ReadPublicKey(verifyFlags.Pub)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		if err := builder.VerifyFile(args[0], verifyFlags.Signature, pub); err != nil {
+			fatal(err)
+		}
+		log.Info().Msgf("%s: signature OK", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVar(&verifyFlags.Pub, "pub", "", "ed25519 public key (PEM) of the signer")
+	verifyCmd.Flags().StringVar(&verifyFlags.Signature, "sig", "", "detached signature of the binary (defaults to <revad>.sig)")
+}
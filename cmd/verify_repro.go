@@ -0,0 +1,257 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/cs3org/gaia/pkg/builder"
+	"github.com/spf13/cobra"
+)
+
+var verifyReproFlags = struct {
+	File    string
+	Offline bool
+	Keep    bool
+}{}
+
+// verifyReproCmd represents the verify-repro command
+var verifyReproCmd = &cobra.Command{
+	Use:     "verify-repro",
+	Short:   "Check that a recipe builds reproducibly",
+	Long:    "Build a recipe twice in fresh workspaces, in reproducible mode, and compare the sha256 digests of the binaries.",
+	PreRunE: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		if verifyReproFlags.File == "" {
+			fmt.Fprintln(os.Stderr, "Error: a recipe must be given with --file")
+			os.Exit(exitUsage)
+		}
+		recipe, err := builder.LoadRecipe(verifyReproFlags.File)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitError)
+		}
+		if len(args) != 0 {
+			recipe.RevaVersion = args[0]
+		}
+		if recipe.Template != "" {
+			recipe.Template = recipeRelative(verifyReproFlags.File, recipe.Template)
+		}
+
+		targets, err := builder.ParseTargets(recipe.Targets)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitError)
+		}
+		cToolchains, err := recipeCToolchains(verifyReproFlags.File, recipe)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitError)
+		}
+		hooks, err := recipe.BuildHooks()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitError)
+		}
+
+		platforms := make([]builder.Platform, 0, len(recipe.Platforms))
+		for _, s := range recipe.Platforms {
+			p, err := builder.ParsePlatform(s)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitError)
+			}
+			platforms = append(platforms, p)
+		}
+
+		dir, err := os.MkdirTemp("", "gaia-repro-*")
+		if err != nil {
+			fatal(err)
+		}
+		if verifyReproFlags.Keep {
+			log.Info().Msgf("binaries are kept in %s", dir)
+		} else {
+			defer os.RemoveAll(dir)
+		}
+
+		// the second build uses the modules resolved by the first one,
+		// so that only the build itself is compared
+		var lock *builder.Lock
+		var builds [2]map[string]string
+		for i := range builds {
+			log.Info().Msgf("build %d of %d", i+1, len(builds))
+			output := filepath.Join(dir, fmt.Sprintf("build-%d", i+1), "revad")
+			if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+				fatal(err)
+			}
+			builds[i], lock, err = reproBuild(ctx, recipe, targets, platforms, cToolchains, hooks, lock, output)
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		reproducible := true
+		for _, name := range slices.Sorted(maps.Keys(builds[0])) {
+			first, second := builds[0][name], builds[1][name]
+			if first == second {
+				fmt.Printf("%s  %s: reproducible\n", first, name)
+				continue
+			}
+			reproducible = false
+			fmt.Printf("%s  %s: first build\n", first, name)
+			fmt.Printf("%s  %s: second build\n", second, name)
+			off, err := firstDifference(filepath.Join(dir, "build-1", name), filepath.Join(dir, "build-2", name))
+			if err != nil {
+				log.Error().Err(err).Msgf("error comparing the binaries %s", name)
+				continue
+			}
+			fmt.Printf("  binaries differ starting at byte %d\n", off)
+		}
+
+		if !reproducible {
+			fmt.Fprintln(os.Stderr, "Error: the builds are not reproducible")
+			os.Exit(exitNotReproducible)
+		}
+	},
+}
+
+// reproBuild builds the recipe in reproducible mode in a fresh workspace.
+// It returns the sha256 digest of each binary, by file name, together with the lock
+// of the modules used.
+func reproBuild(ctx context.Context, recipe *builder.Recipe, targets []builder.Target, platforms []builder.Platform, cToolchains map[builder.Platform]builder.CToolchain, hooks []builder.Hook, lock *builder.Lock, output string) (map[string]string, *builder.Lock, error) {
+	plugins, replacement := recipe.Plugins()
+	b := builder.Builder{
+		RevaVersion:  recipe.RevaVersion,
+		RevaModule:   recipe.RevaModule,
+		Plugins:      plugins,
+		Replacement:  replacement,
+		Debug:        recipe.Debug,
+		Log:          log,
+		Tags:         recipe.Tags,
+		Vendor:       recipe.Vendor,
+		LdFlags:      recipe.LdFlags,
+		Static:       recipe.Static,
+		StaticMusl:   recipe.StaticMusl,
+		CToolchains:  cToolchains,
+		Hooks:        hooks,
+		Offline:      verifyReproFlags.Offline,
+		Reproducible: true,
+		GoVersion:    recipe.GoVersion,
+		Locked:       lock,
+		Template:     recipe.Template,
+		Targets:      targets,
+	}
+	if len(platforms) == 1 {
+		b.Platform = platforms[0]
+	}
+	defer b.Close()
+
+	if err := b.Prepare(ctx); err != nil {
+		return nil, nil, err
+	}
+	if lock == nil {
+		var err error
+		if lock, err = b.Lock(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var outputs []string
+	if len(platforms) > 1 {
+		artifacts, err := b.BuildPlatforms(ctx, output, platforms...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, a := range artifacts {
+			outputs = append(outputs, a.Path)
+		}
+	} else {
+		if err := b.Build(ctx, output); err != nil {
+			return nil, nil, err
+		}
+		for _, t := range targets {
+			outputs = append(outputs, b.TargetOutput(output, t))
+		}
+		if len(targets) == 0 {
+			outputs = append(outputs, output)
+		}
+	}
+
+	digests := make(map[string]string, len(outputs))
+	for _, o := range outputs {
+		d, err := builder.FileSHA256(o)
+		if err != nil {
+			return nil, nil, err
+		}
+		digests[filepath.Base(o)] = d
+	}
+	return digests, lock, nil
+}
+
+// firstDifference returns the offset of the first
+// byte differing between two files.
+func firstDifference(a, b string) (int64, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return 0, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return 0, err
+	}
+	defer fb.Close()
+
+	ra, rb := bufio.NewReader(fa), bufio.NewReader(fb)
+	for off := int64(0); ; off++ {
+		ca, errA := ra.ReadByte()
+		cb, errB := rb.ReadByte()
+		if errA != nil || errB != nil {
+			if errors.Is(errA, io.EOF) && errors.Is(errB, io.EOF) {
+				return 0, errors.New("files are identical")
+			}
+			if (errA != nil && !errors.Is(errA, io.EOF)) || (errB != nil && !errors.Is(errB, io.EOF)) {
+				return 0, errors.Join(errA, errB)
+			}
+			// one of the files is shorter
+			return off, nil
+		}
+		if ca != cb {
+			return off, nil
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(verifyReproCmd)
+
+	verifyReproCmd.Flags().StringVarP(&verifyReproFlags.File, "file", "f", "", "build recipe (gaia.toml or gaia.yaml) to verify")
+	verifyReproCmd.Flags().BoolVar(&verifyReproFlags.Offline, "offline", false, "never access the network: use only the module cache")
+	verifyReproCmd.Flags().BoolVar(&verifyReproFlags.Keep, "keep", false, "keep the binaries of both builds")
+}
@@ -21,6 +21,7 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
@@ -34,9 +35,9 @@ func Go() string {
 	return "go"
 }
 
-func FromGoEnv(key ...string) []string {
+func FromGoEnv(key ...string) ([]string, error) {
 	if len(key) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	var b bytes.Buffer
@@ -46,24 +47,27 @@ func FromGoEnv(key ...string) []string {
 	cmd.Stdout = &b
 	err := cmd.Run()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error running go env: %w", err)
 	}
 
 	var env map[string]string
 	if err := json.Unmarshal(b.Bytes(), &env); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error decoding go env: %w", err)
 	}
 	values := make([]string, 0, len(env))
 	for k, v := range env {
 		values = append(values, k+"="+v)
 	}
-	return values
+	return values, nil
 }
 
-func KeyFromGoEnv(key string) string {
-	values := FromGoEnv(key)
+func KeyFromGoEnv(key string) (string, error) {
+	values, err := FromGoEnv(key)
+	if err != nil {
+		return "", err
+	}
 	if len(values) == 0 {
-		return ""
+		return "", nil
 	}
-	return strings.SplitN(values[0], "=", 2)[1]
+	return strings.SplitN(values[0], "=", 2)[1], nil
 }
@@ -20,26 +20,118 @@ package builder
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
+	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cs3org/gaia/internal/utils"
 	"github.com/rs/zerolog"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
-const revaRepository = "github.com/cs3org/reva/v3"
+const (
+	// revaPathPrefix is the path of reva without the major version suffix.
+	revaPathPrefix = "github.com/cs3org/reva"
+	// DefaultRevaModule is the reva module built when
+	// neither the module nor its major version are given.
+	DefaultRevaModule = revaPathPrefix + "/v3"
+)
+
+// RevaModuleForVersion returns the module path of the given
+// version of reva: github.com/cs3org/reva for v0 and v1,
+// github.com/cs3org/reva/vN otherwise, DefaultRevaModule
+// for queries that are not a version, like latest.
+func RevaModuleForVersion(version string) string {
+	major := semver.Major(version)
+	switch major {
+	case "":
+		return DefaultRevaModule
+	case "v0", "v1":
+		return revaPathPrefix
+	default:
+		return revaPathPrefix + "/" + major
+	}
+}
+
+// revaModule returns the module path of the reva built: the one
+// configured, the reva in the plugins or in the lock, or the one
+// matching the major version of the requested reva.
+func (b *Builder) revaModule() string {
+	if b.RevaModule != "" {
+		return b.RevaModule
+	}
+	for _, p := range b.Plugins {
+		if isRevaModule(p.RepositoryPath) {
+			return p.RepositoryPath
+		}
+	}
+	if b.Locked != nil && b.Locked.Reva.Path != "" {
+		return b.Locked.Reva.Path
+	}
+	return RevaModuleForVersion(b.RevaVersion)
+}
+
+// checkRevaModule rejects the versions of reva before v3, whose
+// cmd/revad is a main package without Main: the generated main
+// could never call it. A custom template may build them its own way.
+func (b *Builder) checkRevaModule() error {
+	if b.Template != "" {
+		return nil
+	}
+	prefix, major, ok := module.SplitPathVersion(b.revaModule())
+	if !ok || prefix != revaPathPrefix {
+		return nil
+	}
+	if major == "" || major == "/v2" {
+		return fmt.Errorf("%w: reva %s (%s) cannot be built, gaia needs reva v3 or later, whose cmd/revad exports Main", ErrVersionNotFound, b.RevaVersion, b.revaModule())
+	}
+	return nil
+}
 
 type Platform struct {
 	OS   string
 	Arch string
 }
 
+// ParsePlatform parses a platform in the form os/arch.
+func ParsePlatform(s string) (Platform, error) {
+	split := strings.SplitN(s, "/", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q: expected os/arch", s)
+	}
+	return Platform{OS: split[0], Arch: split[1]}, nil
+}
+
+func (p Platform) String() string {
+	return p.OS + "/" + p.Arch
+}
+
+// PlatformOutput returns the path where the binary for the
+// given platform is written, when building for several platforms
+// at once.
+func PlatformOutput(output string, p Platform) string {
+	ext := ""
+	if p.OS == "windows" {
+		ext = ".exe"
+		output = strings.TrimSuffix(output, ext)
+	}
+	return output + "_" + p.OS + "_" + p.Arch + ext
+}
+
 type Builder struct {
 	Platform
-	RevaVersion    string
+	RevaVersion string
+	// RevaModule is the module path of reva, inferred
+	// from the requested version when empty.
+	RevaModule     string
 	Tags           []string
 	Plugins        []Plugin
 	Replacement    []Replace
@@ -51,7 +143,56 @@ type Builder struct {
 	LdFlags        string
 	Static         bool
 	StaticMusl     bool
-	w              *workspace
+	// Offline forbids any network access: modules are only
+	// taken from the module cache and the build metadata is
+	// resolved locally.
+	Offline bool
+	// Provenance makes Build write a SLSA provenance
+	// statement next to each binary, see ProvenancePath.
+	Provenance bool
+	// BuilderID identifies the builder in the provenance,
+	// DefaultBuilderID is used when empty.
+	BuilderID string
+	// Reproducible makes two builds of the same inputs produce
+	// the same binary: the build date is taken from SOURCE_DATE_EPOCH
+	// or from the reva commit, paths and VCS information are stripped,
+	// and the local toolchain, or the pinned one, is used for every build.
+	Reproducible bool
+	// GoVersion, if set, pins the go toolchain of the build, e.g. 1.22.5.
+	// It is taken from the toolchain directory or from the module cache
+	// when available, downloaded by the go command otherwise.
+	GoVersion string
+	// ToolchainDir holds the go toolchains as go<version>,
+	// DefaultToolchainDir if empty.
+	ToolchainDir string
+	// Locked, if set, makes Prepare resolve exactly the
+	// modules recorded in the lock, failing on any drift.
+	Locked *Lock
+	// Targets are the reva commands to build,
+	// DefaultTarget if empty.
+	Targets []Target
+	// Template, if set, is the path of a custom template of the
+	// main.go, executed with MainData instead of the built-in one.
+	Template string
+	// Cache, if set, stores every binary built, see FromCache.
+	Cache *Cache
+	// CToolchains are the C toolchains compiling the cgo code, by
+	// platform. The one of the zero Platform applies to every platform
+	// without its own; StaticMusl is the musl preset by default.
+	CToolchains map[Platform]CToolchain
+	// Events, if set, receives the events of the build, see Event.
+	Events EventSink
+	// Hooks run before and after the stages of the build, in the
+	// workspace. A failing hook aborts the build.
+	Hooks []Hook
+	// SignKey, if set, makes Build write the checksum and
+	// the signature of each binary, see SignFile.
+	SignKey ed25519.PrivateKey
+	w       *workspace
+
+	cacheMu       sync.Mutex
+	cacheResolved *CacheInputs
+	resolved      []PluginResolution
 }
 
 func (b *Builder) getWorkspace() error {
@@ -63,14 +204,23 @@ func (b *Builder) getWorkspace() error {
 	var err error
 
 	if b.Platform.Arch == "" {
-		b.Platform.Arch = utils.KeyFromGoEnv("GOARCH")
+		b.Platform.Arch, err = utils.KeyFromGoEnv("GOARCH")
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrToolchainNotFound, err)
+		}
 	}
 	if b.Platform.OS == "" {
-		b.Platform.OS = utils.KeyFromGoEnv("GOOS")
+		b.Platform.OS, err = utils.KeyFromGoEnv("GOOS")
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrToolchainNotFound, err)
+		}
 	}
 	if b.RevaVersion == "" {
 		b.RevaVersion = "latest"
 	}
+	if err := b.checkHooks(); err != nil {
+		return err
+	}
 
 	b.w, err = b.newWorkspace()
 	if err != nil {
@@ -80,8 +230,16 @@ func (b *Builder) getWorkspace() error {
 	b.w.setEnvKV("GOOS", b.Platform.OS)
 	b.w.setEnvKV("GOARCH", b.Platform.Arch)
 
-	if b.StaticMusl {
-		if err := b.checkMuslGcc(); err != nil {
+	if b.Offline {
+		// modules in the cache were already verified when downloaded
+		b.w.setEnvKV("GOPROXY", "off")
+		b.w.setEnvKV("GOSUMDB", "off")
+	}
+
+	// fail before preparing the workspace when the C toolchain
+	// is missing, the others platforms are checked when built
+	if tc, err := b.cToolchain(b.Platform); err == nil && tc != nil {
+		if err := tc.check(); err != nil {
 			return err
 		}
 	}
@@ -89,14 +247,6 @@ func (b *Builder) getWorkspace() error {
 	return nil
 }
 
-func (b *Builder) checkMuslGcc() error {
-	cmd := exec.Command("sh", "-c", "command -v musl-gcc")
-	if err := cmd.Run(); err != nil {
-		return errors.New("musl-gcc not found. Install with: sudo apt install musl-tools (or equivalent for your distribution)")
-	}
-	return nil
-}
-
 func (b *Builder) Prepare(ctx context.Context) error {
 
 	if b.w == nil {
@@ -105,25 +255,162 @@ func (b *Builder) Prepare(ctx context.Context) error {
 		}
 	}
 
+	if err := b.checkRevaModule(); err != nil {
+		return err
+	}
+	if err := b.resolvePlugins(ctx); err != nil {
+		return err
+	}
+
+	// a workspace prepared before is reused: left as is if
+	// prepared with the same inputs, updated otherwise
+	inputs, err := b.prepareInputs()
+	if err != nil {
+		return err
+	}
+	prev, err := b.w.readPrepareState()
+	if err != nil {
+		return err
+	}
+	switch {
+	case prev != nil && prev.Hash == inputs.hash():
+		b.Log.Info().Msgf("workspace %s already prepared with the same inputs", b.w.folder)
+		b.Replacement = prev.Applied
+		// the build date, unless reproducible, is the one of this build
+		return b.writeBuildInfo(ctx)
+	case prev != nil && prev.Inputs.canUpdate(inputs):
+		b.Log.Info().Msgf("updating workspace %s prepared with other inputs", b.w.folder)
+	default:
+		prev = nil
+		if err := b.w.removePrepared(); err != nil {
+			return err
+		}
+	}
+	// an interrupted preparation must not be taken for a complete one
+	if err := os.RemoveAll(filepath.Join(b.w.folder, prepareStateFile)); err != nil {
+		return err
+	}
+
 	b.Log.Info().Msgf("preparing reva using version %s", b.RevaVersion)
 
-	if err := b.w.runGoCommand(ctx, "mod", "init", "revad"); err != nil {
+	if err := b.runStage(ctx, Event{Stage: StageInit}, func(ctx context.Context) error {
+		return b.initModule(ctx, prev)
+	}); err != nil {
+		return err
+	}
+	if err := b.runStage(ctx, Event{Stage: StageReplace}, func(ctx context.Context) error {
+		return b.replaceModules(ctx, prev)
+	}); err != nil {
 		return err
 	}
-	f, err := b.w.CreateFile("main.go")
+	if err := b.runStage(ctx, Event{Stage: StageGet}, func(ctx context.Context) error {
+		return b.getModules(ctx, prev)
+	}); err != nil {
+		return err
+	}
+
+	// run go mod tidy to fix all the modules
+	if err := b.runStage(ctx, Event{Stage: StageTidy}, func(ctx context.Context) error {
+		if err := b.w.runGoCommand(ctx, "mod", "tidy"); err != nil {
+			return err
+		}
+		if b.Locked != nil {
+			return b.verifyLock(ctx, b.Locked)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if b.Vendor {
+		// Keep all modules locally
+		if err := b.runStage(ctx, Event{Stage: StageVendor}, func(ctx context.Context) error {
+			return b.w.runGoCommand(ctx, "mod", "vendor")
+		}); err != nil {
+			return err
+		}
+	} else if prev != nil {
+		// the go command would keep building from it
+		if err := os.RemoveAll(filepath.Join(b.w.folder, "vendor")); err != nil {
+			return err
+		}
+	}
+
+	if err := b.writeBuildInfo(ctx); err != nil {
+		return err
+	}
+
+	return b.w.writePrepareState(&prepareState{
+		Hash:    inputs.hash(),
+		Inputs:  *inputs,
+		Applied: b.Replacement,
+	})
+}
+
+// writeBuildInfo writes the build flags and the main packages
+// embedding the description of the build in the workspace.
+func (b *Builder) writeBuildInfo(ctx context.Context) error {
+	// add compile time flags for version, commit, go version and build date
+	// store them in the project so that it can be used independently
+	bflags, err := b.w.generateBuildFlags(ctx, b.Replacement, b.Offline, b.Reproducible)
+	if err != nil {
+		return err
+	}
+	f, err := b.w.CreateFile("bflags")
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	if err := writeMainWithPlugins(f, b.Plugins); err != nil {
+	if _, err := f.WriteString(bflags.Format(b.variablesPaths()...)); err != nil {
+		return fmt.Errorf("error writing build flags: %w", err)
+	}
+	if err := f.Close(); err != nil {
 		return err
 	}
 
+	// now that the versions are resolved, embed
+	// the description of the build in the binaries
+	for _, t := range b.targets() {
+		info, err := b.describe(ctx, t, bflags)
+		if err != nil {
+			return err
+		}
+		if err := b.writeMain(t, info, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initModule creates the module of the workspace, unless prepared
+// before, and writes the main packages of the targets.
+func (b *Builder) initModule(ctx context.Context, prev *prepareState) error {
+	if prev == nil {
+		if err := b.w.runGoCommand(ctx, "mod", "init", "revad"); err != nil {
+			return err
+		}
+	}
+	// the main packages of the targets no longer built
+	// must not keep their imports in the module
+	if err := os.RemoveAll(filepath.Join(b.w.folder, targetsDir)); err != nil {
+		return err
+	}
+	for _, t := range b.targets() {
+		if err := b.writeMain(t, b.requestedInfo(t), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceModules applies the replacements to the module,
+// undoing the ones of the previous preparation.
+func (b *Builder) replaceModules(ctx context.Context, prev *prepareState) error {
 	// if the reva repository has been replaced with a local one
 	// it might have further replacements
 	// if we do not consider them, the compilation will fail
-	if path, ok := isRevaLocalReplacement(b.Replacement); ok {
+	if path, ok := isRevaLocalReplacement(b.w.reva, b.Replacement); ok {
 		if gomod, err := parseGoModFile(ctx, filepath.Join(path, "go.mod")); err != nil {
 			b.Log.Error().Err(err).Send()
 		} else {
@@ -139,53 +426,130 @@ func (b *Builder) Prepare(ctx context.Context) error {
 		}
 	}
 
+	if prev != nil {
+		if err := b.w.resetRequirements(ctx, b.Plugins, prev.Applied, b.Replacement); err != nil {
+			return err
+		}
+	}
+
 	// do the replacement of the modules
 	if len(b.Replacement) != 0 {
 		if err := b.w.runGoModReplaceCommand(ctx, b.Replacement); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// getModules adds the plugins and reva to the module, checking
+// the compatibility of the plugins, or the modules of the lock.
+func (b *Builder) getModules(ctx context.Context, prev *prepareState) error {
+	if b.Locked != nil {
+		b.Log.Info().Msg("using the module versions recorded in the lock file")
+		return b.applyLock(ctx, b.Locked)
+	}
 
 	// TODO: verify all the versions
-	for _, plugin := range b.Plugins {
+	fetched := false
+	plugins := resolvedPlugins(b.Plugins, b.resolved)
+	for i, plugin := range b.Plugins {
+		if prev != nil && slices.Contains(prev.Inputs.Resolved, plugins[i]) {
+			b.Log.Debug().Msgf("plugin %s already in the workspace", plugin)
+			continue
+		}
 		b.Log.Info().Msgf("adding plugin %s", plugin)
-		if err := b.w.runGoGetCommand(ctx, plugin.RepositoryPath, plugin.Version); err != nil {
+		if err := b.fetchPlugin(ctx, plugin, i+1, len(b.Plugins)); err != nil {
 			return err
 		}
+		fetched = true
 	}
-	if err := b.w.runGoGetCommand(ctx, revaRepository, b.RevaVersion); err != nil {
+
+	// before pinning reva, that would silently downgrade
+	// the plugins requiring a newer version
+	report, err := b.checkCompatibility(ctx)
+	if err != nil {
 		return err
 	}
+	for _, i := range report.Issues {
+		if i.Severity == CompatWarning {
+			b.Log.Warn().Msg(i.Message)
+		}
+	}
+	if report.HasErrors() {
+		return &CompatibilityError{Report: report}
+	}
 
-	// run go mod tidy to fix all the modules
-	if err := b.w.runGoCommand(ctx, "mod", "tidy"); err != nil {
-		return err
+	// a new plugin may have raised reva, and a removed
+	// one or replacement left it raised in the go.mod
+	if prev == nil || fetched || prev.Inputs.RevaVersion != b.RevaVersion ||
+		!slices.Equal(prev.Inputs.Resolved, plugins) || !slices.Equal(prev.Applied, b.Replacement) {
+		return b.w.runGoGetCommand(ctx, b.w.reva, b.RevaVersion)
 	}
+	return nil
+}
 
-	if b.Vendor {
-		// Keep all modules locally
-		if err := b.w.runGoCommand(ctx, "mod", "vendor"); err != nil {
-			return err
+// requestedInfo describes the build of the target
+// as requested, before the modules are resolved.
+func (b *Builder) requestedInfo(t Target) *BinaryInfo {
+	info := &BinaryInfo{
+		GaiaVersion:  gaiaVersion(),
+		RevaModule:   b.w.reva,
+		RevaVersion:  b.RevaVersion,
+		Tags:         b.Tags,
+		LdFlags:      b.LdFlags,
+		Debug:        b.Debug,
+		Static:       b.Static,
+		StaticMusl:   b.StaticMusl,
+		Vendor:       b.Vendor,
+		Reproducible: b.Reproducible,
+		Template:     b.Template,
+	}
+	if t != DefaultTarget {
+		info.Target = &t
+	}
+	for _, p := range b.Plugins {
+		if p.RepositoryPath == b.w.reva {
+			continue
 		}
+		info.Plugins = append(info.Plugins, p)
 	}
-
-	// add compile time flags for version, commit, go version and build date
-	// store them in the project so that it can be used independently
-	bflags := b.w.generateBuildFlags(b.Replacement)
-	f, err = b.w.CreateFile("bflags")
-	if err != nil {
-		return err
+	for _, r := range b.Replacement {
+		if r.From == b.w.reva {
+			info.RevaReplace = &r
+			continue
+		}
+		info.Replacement = append(info.Replacement, r)
 	}
-	defer f.Close()
+	return info
+}
 
-	_, err = f.WriteString(bflags.Format())
+// describe returns the description of the build
+// of the target, embedded in its generated main.go.
+func (b *Builder) describe(ctx context.Context, t Target, bflags buildFlags) (*BinaryInfo, error) {
+	modules, err := b.w.listModules(ctx)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return nil
+	info := b.requestedInfo(t)
+	info.GitCommit = bflags.GitCommit
+	info.GoVersion = bflags.GoVersion
+	if bflags.BuildDate.Unix() != 0 {
+		info.BuildDate = bflags.BuildDate.Format(time.RFC3339)
+	}
+	if reva, ok := moduleOf(modules, b.w.reva); ok {
+		info.RevaVersion = reva.Version
+	}
+	for i, p := range info.Plugins {
+		if m, ok := moduleOf(modules, p.RepositoryPath); ok {
+			info.Plugins[i].Version = m.Version
+		}
+	}
+	return info, nil
 }
 
+// Build compiles the prepared workspace for the platform of the builder,
+// writing the binary of each target to the path returned by TargetOutput.
 func (b *Builder) Build(ctx context.Context, output string) error {
 
 	if b.w == nil {
@@ -194,7 +558,70 @@ func (b *Builder) Build(ctx context.Context, output string) error {
 		}
 	}
 
-	b.Log.Info().Msgf("building reva using workspace %s", b.w.folder)
+	for _, t := range b.targets() {
+		if err := b.build(ctx, b.Platform, t, b.TargetOutput(output, t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildPlatforms compiles the prepared workspace once for each of the
+// given platforms and targets. The builds run in parallel, and each binary
+// is written to the path returned by PlatformOutput for the target output.
+// It returns the binaries built, by target and then by platform.
+func (b *Builder) BuildPlatforms(ctx context.Context, output string, platforms ...Platform) ([]Artifact, error) {
+
+	if b.w == nil {
+		if err := b.getWorkspace(); err != nil {
+			return nil, err
+		}
+	}
+
+	if output == "" {
+		return nil, errors.New("output file name cannot be empty")
+	}
+
+	var artifacts []Artifact
+	for _, t := range b.targets() {
+		for _, p := range platforms {
+			artifacts = append(artifacts, Artifact{
+				Target:   t,
+				Platform: p,
+				Path:     PlatformOutput(b.TargetOutput(output, t), p),
+			})
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, a := range artifacts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.build(ctx, a.Platform, a.Target, a.Path)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error building %s for %s: %w", a.Target.Name, a.Platform, err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+func (b *Builder) build(ctx context.Context, p Platform, t Target, output string) error {
+	b.Log.Info().Msgf("building %s for %s using workspace %s", t.Name, p, b.w.folder)
+	started := time.Now()
 
 	if output == "" {
 		return errors.New("output file name cannot be empty")
@@ -205,9 +632,37 @@ func (b *Builder) Build(ctx context.Context, output string) error {
 		return err
 	}
 
-	if b.StaticMusl {
-		b.w.setEnvKV("CC", "musl-gcc")
-		b.Log.Info().Msg("using musl-gcc for static build")
+	// every build gets its own copy of the environment,
+	// so that builds for different platforms can run in parallel
+	w := b.w.clone()
+	w.setEnvKV("GOOS", p.OS)
+	w.setEnvKV("GOARCH", p.Arch)
+
+	tc, err := b.cToolchain(p)
+	if err != nil {
+		return err
+	}
+	if tc != nil {
+		if err := tc.check(); err != nil {
+			return err
+		}
+		w.setEnvKV("CC", tc.CC)
+		if tc.CXX != "" {
+			w.setEnvKV("CXX", tc.CXX)
+		}
+		for _, env := range tc.cgoFlags() {
+			w.setEnv(env)
+		}
+		b.Log.Info().Msgf("using %s to compile the C code for %s", tc.CC, p)
+	}
+	if p != w.host && os.Getenv("CGO_ENABLED") == "" {
+		// like the go command, do not use cgo when cross compiling,
+		// unless explicitly asked or given a C cross compiler
+		if tc != nil {
+			w.setEnvKV("CGO_ENABLED", "1")
+		} else {
+			w.setEnvKV("CGO_ENABLED", "0")
+		}
 	}
 
 	args := make(buildArgs)
@@ -217,30 +672,27 @@ func (b *Builder) Build(ctx context.Context, output string) error {
 		args.Add("-trimpath", "")
 		args.Add("-ldflags", "-w", "-s")
 	}
+	if b.Reproducible {
+		// the workspace path and the VCS state must not end up in the binary
+		args.Add("-trimpath", "")
+		args.Add("-buildvcs=false", "")
+	}
 
-	if b.StaticMusl {
-		tags := make([]string, 0, len(b.Tags)+1)
-		tags = append(tags, b.Tags...)
-		hasSqliteTag := false
-		for _, tag := range tags {
-			if tag == "sqlite_omit_load_extension" {
-				hasSqliteTag = true
-				break
+	tags := slices.Clone(b.Tags)
+	if tc != nil {
+		for _, tag := range tc.Tags {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+				b.Log.Info().Msgf("adding %s build tag for the C toolchain", tag)
 			}
 		}
-		if !hasSqliteTag {
-			tags = append(tags, "sqlite_omit_load_extension")
-			b.Log.Info().Msg("adding sqlite_omit_load_extension build tag for musl static build")
-		}
-		if len(tags) > 0 {
-			args.Add("-tags", strings.Join(tags, ","))
-		}
-	} else if len(b.Tags) > 0 {
-		args.Add("-tags", strings.Join(b.Tags, ","))
+	}
+	if len(tags) > 0 {
+		args.Add("-tags", strings.Join(tags, ","))
 	}
 
 	// add compile time flags for version, commit, go version and build date
-	f, err := b.w.OpenFile("bflags")
+	f, err := w.OpenFile("bflags")
 	if err != nil {
 		return err
 	}
@@ -248,7 +700,7 @@ func (b *Builder) Build(ctx context.Context, output string) error {
 
 	bflags, err := os.ReadFile(f.Name())
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("error reading build flags: %w", err)
 	}
 
 	b.Log.Debug().Interface("flags", bflags).Msg("using the following build flags")
@@ -263,13 +715,13 @@ func (b *Builder) Build(ctx context.Context, output string) error {
 		b.Log.Info().Str("ldflags", b.LdFlags).Msg("adding custom ldflags")
 	}
 
-	if b.StaticMusl {
+	if tc != nil && tc.ExtLdFlags != "" {
 		if !strings.Contains(ldflags, "-extldflags") {
 			if ldflags != "" {
 				ldflags += " "
 			}
-			ldflags += "-extldflags '-static'"
-			b.Log.Info().Msg("adding musl static linking flags (-extldflags '-static')")
+			ldflags += "-extldflags '" + tc.ExtLdFlags + "'"
+			b.Log.Info().Msgf("adding the linking flags of the C toolchain (-extldflags '%s')", tc.ExtLdFlags)
 		} else {
 			b.Log.Info().Msg("extldflags already present in ldflags, skipping")
 		}
@@ -291,14 +743,65 @@ func (b *Builder) Build(ctx context.Context, output string) error {
 		args.Add("-mod=vendor")
 	}
 
-	b.Log.Info().Msg("building revad binary")
-	if err := b.w.runGoBuildCommand(ctx, "main.go", output, args.Format()...); err != nil {
+	src := "main.go"
+	if t != DefaultTarget {
+		src = "./" + filepath.ToSlash(t.mainDir())
+	}
+	b.Log.Info().Msgf("building %s binary for %s", t.Name, p)
+	compile := Event{Stage: StageCompile, Platform: p.String(), Target: t.Name, Output: output}
+	if err := b.runStage(ctx, compile, func(ctx context.Context) error {
+		if err := w.runGoBuildCommand(ctx, src, output, args.Format()...); err != nil {
+			return &CompileError{Platform: p, Target: t.Name, Err: err}
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
 
+	if b.Cache != nil {
+		// the binary is built anyway: a cache failure is not fatal
+		if err := b.storeInCache(ctx, p, t, output); err != nil {
+			b.Log.Warn().Err(err).Msgf("error storing %s in the cache", output)
+		}
+	}
+
+	if b.Provenance {
+		if err := b.writeProvenance(ctx, p, output, args, started); err != nil {
+			return fmt.Errorf("error writing provenance: %w", err)
+		}
+	}
+
+	if b.SignKey != nil {
+		if err := SignFile(output, b.SignKey); err != nil {
+			return fmt.Errorf("error signing %s: %w", output, err)
+		}
+	}
+
 	return nil
 }
 
+const gaiaModule = "github.com/cs3org/gaia"
+
+// gaiaVersion returns the version of gaia building reva.
+func gaiaVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "<unknown>"
+	}
+	if bi.Main.Path == gaiaModule {
+		return bi.Main.Version
+	}
+	for _, m := range bi.Deps {
+		if m.Path == gaiaModule {
+			return m.Version
+		}
+	}
+	return "<unknown>"
+}
+
 func (b *Builder) Close() {
+	if b.w == nil {
+		return
+	}
 	b.w.Close()
 }
@@ -0,0 +1,456 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+const (
+	cacheBinaryName = "revad"
+	cacheEntryName  = "entry.json"
+)
+
+// ErrNotCacheable is returned when the inputs of a build
+// cannot be pinned, so that its binary cannot be cached.
+var ErrNotCacheable = errors.New("build not cacheable")
+
+// Cache is a local cache of built binaries, addressed
+// by the hash of the resolved inputs of the build.
+type Cache struct {
+	Dir string
+	// MaxSize, if not zero, is the size the cache is kept within:
+	// Put removes the least recently used binaries beyond it.
+	MaxSize int64
+}
+
+// DefaultCacheDir returns the default location of
+// the cache, in the user cache directory.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gaia", "binaries"), nil
+}
+
+// CacheInputs are the resolved inputs of a build
+// the cache key is computed from.
+type CacheInputs struct {
+	GaiaVersion     string      `json:"gaia_version"`
+	RevaModule      string      `json:"reva_module"`
+	RevaVersion     string      `json:"reva_version"`
+	Plugins         []Plugin    `json:"plugins,omitempty"`
+	Replacement     []Replace   `json:"replacements,omitempty"`
+	Template        string      `json:"template,omitempty"`
+	Target          *Target     `json:"target,omitempty"`
+	Platform        Platform    `json:"platform"`
+	Tags            []string    `json:"tags,omitempty"`
+	LdFlags         string      `json:"ldflags,omitempty"`
+	GoVersion       string      `json:"go_version"`
+	Debug           bool        `json:"debug,omitempty"`
+	Static          bool        `json:"static,omitempty"`
+	StaticMusl      bool        `json:"static_musl,omitempty"`
+	CToolchain      *CToolchain `json:"c_toolchain,omitempty"`
+	Reproducible    bool        `json:"reproducible,omitempty"`
+	SourceDateEpoch string      `json:"source_date_epoch,omitempty"`
+	Hooks           []string    `json:"hooks,omitempty"`
+}
+
+// Key returns the canonical key of the inputs.
+func (in *CacheInputs) Key() string {
+	data, _ := json.Marshal(in)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// CacheEntry is a binary stored in the cache.
+type CacheEntry struct {
+	Key      string      `json:"key"`
+	Inputs   CacheInputs `json:"inputs"`
+	Size     int64       `json:"size"`
+	Created  time.Time   `json:"created"`
+	LastUsed time.Time   `json:"last_used"`
+}
+
+func (c *Cache) entryDir(key string) string {
+	return filepath.Join(c.Dir, key)
+}
+
+func (c *Cache) readEntry(key string) (*CacheEntry, error) {
+	data, err := os.ReadFile(filepath.Join(c.entryDir(key), cacheEntryName))
+	if err != nil {
+		return nil, err
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("error decoding cache entry %s: %w", key, err)
+	}
+	return &e, nil
+}
+
+func (c *Cache) writeEntry(dir string, e *CacheEntry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, cacheEntryName), append(data, '\n'), 0644)
+}
+
+// Get copies the binary stored under the key to output.
+// It returns false if the cache does not have it.
+func (c *Cache) Get(key, output string) (bool, error) {
+	e, err := c.readEntry(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := copyFile(filepath.Join(c.entryDir(key), cacheBinaryName), output, 0755); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	e.LastUsed = time.Now().UTC()
+	return true, c.writeEntry(c.entryDir(key), e)
+}
+
+// Put stores the binary built from the given inputs.
+func (c *Cache) Put(in *CacheInputs, binary string) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	// prepare the entry aside, and move it in place at once,
+	// so that a concurrent build never sees it half written
+	tmp, err := os.MkdirTemp(c.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := copyFile(binary, filepath.Join(tmp, cacheBinaryName), 0755); err != nil {
+		return err
+	}
+	fi, err := os.Stat(binary)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	e := &CacheEntry{
+		Key:      in.Key(),
+		Inputs:   *in,
+		Size:     fi.Size(),
+		Created:  now,
+		LastUsed: now,
+	}
+	if err := c.writeEntry(tmp, e); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, c.entryDir(e.Key)); err != nil {
+		if _, statErr := os.Stat(c.entryDir(e.Key)); statErr == nil {
+			// stored in the meantime by another build
+			return nil
+		}
+		return err
+	}
+	if c.MaxSize != 0 {
+		if _, err := c.Prune(0, c.MaxSize); err != nil {
+			return fmt.Errorf("error pruning the cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// List returns the entries of the cache,
+// the most recently used first.
+func (c *Cache) List() ([]CacheEntry, error) {
+	dirs, err := os.ReadDir(c.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []CacheEntry
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		e, err := c.readEntry(d.Name())
+		if err != nil {
+			// not a valid entry, left to clear
+			continue
+		}
+		entries = append(entries, *e)
+	}
+	slices.SortFunc(entries, func(a, b CacheEntry) int { return b.LastUsed.Compare(a.LastUsed) })
+	return entries, nil
+}
+
+// Prune removes the entries not used for longer than maxAge, if
+// not zero, then the least recently used ones until the cache is
+// not bigger than maxSize, if not zero. It returns the removed entries.
+func (c *Cache) Prune(maxAge time.Duration, maxSize int64) ([]CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	var removed []CacheEntry
+	for _, e := range entries {
+		tooOld := maxAge != 0 && time.Since(e.LastUsed) > maxAge
+		tooBig := maxSize != 0 && size+e.Size > maxSize
+		if !tooOld && !tooBig {
+			size += e.Size
+			continue
+		}
+		if err := os.RemoveAll(c.entryDir(e.Key)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
+
+// Clear removes all the entries of the cache.
+func (c *Cache) Clear() error {
+	return os.RemoveAll(c.Dir)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// cacheInputs returns the resolved inputs of the build of the target
+// for the given platform. Version queries (latest, branches, ...) are resolved, so
+// that a new release is not hidden by a cached binary. Builds using
+// local directories are not cacheable, as their content can change.
+func (b *Builder) cacheInputs(ctx context.Context, p Platform, t Target) (*CacheInputs, error) {
+	// the platforms may be built in parallel
+	b.cacheMu.Lock()
+	defer b.cacheMu.Unlock()
+
+	if b.cacheResolved == nil {
+		resolved, err := b.resolveCacheInputs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.cacheResolved = resolved
+	}
+	if p == (Platform{}) {
+		p = b.Platform
+	}
+	in := *b.cacheResolved
+	in.Platform = p
+	if t != DefaultTarget {
+		in.Target = &t
+	}
+	tc, err := b.cToolchain(p)
+	if err != nil {
+		return nil, err
+	}
+	in.CToolchain = tc
+	return &in, nil
+}
+
+func (b *Builder) resolveCacheInputs(ctx context.Context) (*CacheInputs, error) {
+	if b.w == nil {
+		if err := b.getWorkspace(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range b.Replacement {
+		if r.ToVersion == "" && (filepath.IsAbs(r.To) || strings.HasPrefix(r.To, ".")) {
+			return nil, fmt.Errorf("%w: %s is replaced by the local directory %s", ErrNotCacheable, r.From, r.To)
+		}
+	}
+
+	if err := b.checkRevaModule(); err != nil {
+		return nil, err
+	}
+
+	// the version of the plugins requested with a range
+	// is the one the build will use
+	if err := b.resolvePlugins(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, h := range b.Hooks {
+		if h.Func != nil {
+			return nil, fmt.Errorf("%w: the %s hook is a Go callback", ErrNotCacheable, h.Point)
+		}
+		// a cached binary is taken without compiling it
+		if h.Point == PostStage(StageCompile) {
+			return nil, fmt.Errorf("%w: the %s hooks would not run on a cached binary", ErrNotCacheable, h.Point)
+		}
+	}
+
+	template, err := b.templateDigest()
+	if err != nil {
+		return nil, err
+	}
+	tags := slices.Clone(b.Tags)
+	slices.Sort(tags)
+
+	in := &CacheInputs{
+		GaiaVersion:  gaiaVersion(),
+		RevaModule:   b.revaModule(),
+		Replacement:  b.Replacement,
+		Template:     template,
+		Tags:         tags,
+		LdFlags:      b.LdFlags,
+		GoVersion:    b.w.goVer,
+		Debug:        b.Debug,
+		Static:       b.Static,
+		StaticMusl:   b.StaticMusl,
+		Reproducible: b.Reproducible,
+		Hooks:        b.hookStrings(func(HookPoint) bool { return true }),
+	}
+	if b.Reproducible {
+		// embedded in the binary as its build date
+		in.SourceDateEpoch = os.Getenv(SourceDateEpochEnv)
+	}
+
+	in.RevaVersion, err = b.resolveCacheVersion(ctx, in.RevaModule, b.RevaVersion)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range b.Plugins {
+		if p.RepositoryPath == in.RevaModule {
+			continue
+		}
+		v, err := b.resolveCacheVersion(ctx, p.RepositoryPath, b.pluginVersion(p))
+		if err != nil {
+			return nil, err
+		}
+		in.Plugins = append(in.Plugins, Plugin{RepositoryPath: p.RepositoryPath, Version: v})
+	}
+	return in, nil
+}
+
+// resolveCacheVersion returns the exact version the package is built
+// at: the one in the lock, the requested one if already exact, or the
+// one the version query resolves to.
+func (b *Builder) resolveCacheVersion(ctx context.Context, pkg, version string) (string, error) {
+	if b.Locked != nil {
+		m, ok := b.Locked.module(pkg)
+		if !ok {
+			return "", fmt.Errorf("%w: %s is not in the lock file", ErrNotCacheable, pkg)
+		}
+		return m.Version, nil
+	}
+	if semver.IsValid(version) && semver.Canonical(version) == version {
+		return version, nil
+	}
+	if version == "" {
+		version = "latest"
+	}
+
+	// the package may be in a subdirectory of its module
+	var errs []error
+	for mod := pkg; strings.Contains(mod, "/"); mod = path.Dir(mod) {
+		out, err := b.w.outputGoCommand(ctx, "list", "-m", "-json", mod+"@"+version)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var m Module
+		if err := json.Unmarshal(out, &m); err != nil {
+			return "", err
+		}
+		return m.Version, nil
+	}
+	return "", fmt.Errorf("%w: cannot resolve %s@%s: %w", ErrNotCacheable, pkg, version, errors.Join(errs...))
+}
+
+// FromCache copies the binary of the target built for the given platform,
+// the one of the builder if zero, from the cache to output. It returns
+// false on a cache miss, or if the build is not cacheable.
+func (b *Builder) FromCache(ctx context.Context, p Platform, t Target, output string) (bool, error) {
+	if b.Cache == nil {
+		return false, nil
+	}
+	in, err := b.cacheInputs(ctx, p, t)
+	if errors.Is(err, ErrNotCacheable) {
+		b.Log.Debug().Err(err).Msg("not using the cache")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return false, err
+	}
+	hit, err := b.Cache.Get(in.Key(), output)
+	if err != nil || !hit {
+		return hit, err
+	}
+	if b.SignKey != nil {
+		if err := SignFile(output, b.SignKey); err != nil {
+			return false, fmt.Errorf("error signing %s: %w", output, err)
+		}
+	}
+	return true, nil
+}
+
+// storeInCache stores the binary of the target
+// built for the platform in the cache.
+func (b *Builder) storeInCache(ctx context.Context, p Platform, t Target, output string) error {
+	in, err := b.cacheInputs(ctx, p, t)
+	if errors.Is(err, ErrNotCacheable) {
+		b.Log.Debug().Err(err).Msg("not storing the binary in the cache")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.Cache.Put(in, output)
+}
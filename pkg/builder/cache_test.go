@@ -0,0 +1,80 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import "testing"
+
+func TestCacheInputsKey(t *testing.T) {
+	base := func() CacheInputs {
+		return CacheInputs{
+			GaiaVersion: "v1.0.0",
+			RevaModule:  "github.com/cs3org/reva/v3",
+			RevaVersion: "v3.0.1",
+			Plugins:     []Plugin{{RepositoryPath: "example.org/plugin", Version: "v1.2.0"}},
+			Platform:    Platform{OS: "linux", Arch: "amd64"},
+			GoVersion:   "1.22.5",
+		}
+	}
+	in := base()
+	key := in.Key()
+	if len(key) != 64 {
+		t.Fatalf("Key() = %q, want a hex SHA-256", key)
+	}
+	if again := base(); again.Key() != key {
+		t.Fatalf("Key() is not stable: %s and %s", key, again.Key())
+	}
+
+	tests := []struct {
+		name   string
+		change func(*CacheInputs)
+	}{
+		{"reva version", func(in *CacheInputs) { in.RevaVersion = "v3.0.2" }},
+		{"reva module", func(in *CacheInputs) { in.RevaModule = "example.org/fork/reva/v3" }},
+		{"plugin version", func(in *CacheInputs) { in.Plugins[0].Version = "v1.2.1" }},
+		{"plugin added", func(in *CacheInputs) {
+			in.Plugins = append(in.Plugins, Plugin{RepositoryPath: "example.org/other", Version: "v0.1.0"})
+		}},
+		{"replacement", func(in *CacheInputs) {
+			in.Replacement = []Replace{{From: "example.org/lib", To: "example.org/fork", ToVersion: "v1.0.0"}}
+		}},
+		{"template", func(in *CacheInputs) { in.Template = "sha256:abc" }},
+		{"target", func(in *CacheInputs) { in.Target = &Target{Name: "reva", Package: "cmd/reva"} }},
+		{"platform", func(in *CacheInputs) { in.Platform.Arch = "arm64" }},
+		{"tags", func(in *CacheInputs) { in.Tags = []string{"sqlite_omit_load_extension"} }},
+		{"ldflags", func(in *CacheInputs) { in.LdFlags = "-X main.x=y" }},
+		{"go version", func(in *CacheInputs) { in.GoVersion = "1.23.0" }},
+		{"debug", func(in *CacheInputs) { in.Debug = true }},
+		{"static", func(in *CacheInputs) { in.Static = true }},
+		{"static musl", func(in *CacheInputs) { in.StaticMusl = true }},
+		{"reproducible", func(in *CacheInputs) { in.Reproducible = true }},
+		{"source date epoch", func(in *CacheInputs) { in.Reproducible, in.SourceDateEpoch = true, "1700000000" }},
+		{"hooks", func(in *CacheInputs) { in.Hooks = []string{"pre-compile=go generate ./..."} }},
+		{"gaia version", func(in *CacheInputs) { in.GaiaVersion = "v1.1.0" }},
+	}
+	seen := map[string]string{key: "base"}
+	for _, tt := range tests {
+		in := base()
+		tt.change(&in)
+		k := in.Key()
+		if other, ok := seen[k]; ok {
+			t.Errorf("changing the %s gives the key of the %s", tt.name, other)
+		}
+		seen[k] = tt.name
+	}
+}
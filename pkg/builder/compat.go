@@ -0,0 +1,260 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// CompatSeverity tells whether a compatibility
+// issue prevents the build.
+type CompatSeverity string
+
+const (
+	CompatError   CompatSeverity = "error"
+	CompatWarning CompatSeverity = "warning"
+)
+
+// CompatIssue is a problem found between a plugin
+// and the reva version being built.
+type CompatIssue struct {
+	Severity CompatSeverity `json:"severity"`
+	Plugin   string         `json:"plugin,omitempty"`
+	Module   string         `json:"module,omitempty"`
+	Version  string         `json:"version,omitempty"`
+	Message  string         `json:"message"`
+}
+
+func (i CompatIssue) String() string {
+	s := string(i.Severity) + ": "
+	if i.Plugin != "" {
+		s += "plugin " + i.Plugin + ": "
+	}
+	return s + i.Message
+}
+
+// CompatReport is the result of the compatibility
+// check of the plugins against reva.
+type CompatReport struct {
+	RevaVersion string        `json:"reva_version"`
+	Issues      []CompatIssue `json:"issues,omitempty"`
+}
+
+// HasErrors returns true if any of the issues prevents the build.
+func (r *CompatReport) HasErrors() bool {
+	return slices.ContainsFunc(r.Issues, func(i CompatIssue) bool { return i.Severity == CompatError })
+}
+
+func (r *CompatReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "compatibility of the plugins with reva %s:", r.RevaVersion)
+	if len(r.Issues) == 0 {
+		b.WriteString(" ok")
+	}
+	for _, i := range r.Issues {
+		b.WriteString("\n\t" + i.String())
+	}
+	return b.String()
+}
+
+func (r *CompatReport) add(severity CompatSeverity, plugin, mod, version, format string, args ...any) {
+	r.Issues = append(r.Issues, CompatIssue{
+		Severity: severity,
+		Plugin:   plugin,
+		Module:   mod,
+		Version:  version,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// isRevaModule returns true if the module is reva, in any major version.
+func isRevaModule(path string) bool {
+	prefix, _, ok := module.SplitPathVersion(path)
+	return ok && prefix == revaPathPrefix
+}
+
+// checkCompatibility analyses the module graph of the workspace, where
+// the plugins have already been added but reva not yet pinned to the
+// requested version, looking for plugins that cannot be built with it:
+// plugins requiring a newer reva, another major version of reva, or
+// conflicting major versions of the same module.
+func (b *Builder) checkCompatibility(ctx context.Context) (*CompatReport, error) {
+	report := &CompatReport{RevaVersion: b.RevaVersion}
+
+	// the same plugin requested twice at different versions:
+	// only the last one would silently win
+	requested := make(map[string]string)
+	for _, p := range b.Plugins {
+		if v, ok := requested[p.RepositoryPath]; ok && v != p.Version {
+			report.add(CompatError, p.RepositoryPath, p.RepositoryPath, p.Version,
+				"requested both at %q and %q", v, p.Version)
+		}
+		requested[p.RepositoryPath] = p.Version
+	}
+
+	// the reva that will be built, and what it requires
+	target, revaRequire := b.resolveRevaRequirements(ctx)
+	if target != "" {
+		report.RevaVersion = target
+	}
+
+	modules, err := b.w.listModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	graph, err := b.w.moduleGraph(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// module path without major version -> major version -> who requires it
+	majors := make(map[string]map[string][]string)
+	addMajor := func(path, owner string) {
+		prefix, major, ok := module.SplitPathVersion(path)
+		if !ok || prefix == revaPathPrefix {
+			return
+		}
+		if majors[prefix] == nil {
+			majors[prefix] = make(map[string][]string)
+		}
+		if !slices.Contains(majors[prefix][major], owner) {
+			majors[prefix][major] = append(majors[prefix][major], owner)
+		}
+	}
+	for _, path := range revaRequire {
+		addMajor(path, "reva")
+	}
+
+	for _, p := range b.Plugins {
+		if p.RepositoryPath == b.w.reva {
+			continue
+		}
+		m, ok := moduleOf(modules, p.RepositoryPath)
+		if !ok {
+			// go get would have failed already
+			continue
+		}
+		for _, req := range graph[m.Path+"@"+m.Version] {
+			path, version, _ := strings.Cut(req, "@")
+			switch {
+			case path == b.w.reva:
+				if target != "" && semver.IsValid(target) && semver.Compare(version, target) > 0 {
+					report.add(CompatError, p.RepositoryPath, path, version,
+						"requires reva %s, newer than the requested %s", version, target)
+				}
+			case isRevaModule(path):
+				report.add(CompatError, p.RepositoryPath, path, version,
+					"requires %s@%s, while building %s", path, version, b.w.reva)
+			default:
+				addMajor(path, p.RepositoryPath)
+			}
+		}
+	}
+
+	for _, prefix := range slices.Sorted(maps.Keys(majors)) {
+		byMajor := majors[prefix]
+		if len(byMajor) < 2 {
+			continue
+		}
+		var parts []string
+		for _, major := range slices.Sorted(maps.Keys(byMajor)) {
+			parts = append(parts, prefix+major+" by "+strings.Join(byMajor[major], ", "))
+		}
+		report.add(CompatWarning, "", prefix, "",
+			"different major versions of %s are required: %s", prefix, strings.Join(parts, "; "))
+	}
+
+	return report, nil
+}
+
+// resolveRevaRequirements returns the exact version of reva that will be
+// built, empty if it cannot be known in advance, and the modules it requires.
+func (b *Builder) resolveRevaRequirements(ctx context.Context) (string, []string) {
+	var gomodPath, version string
+	if path, ok := isRevaLocalReplacement(b.w.reva, b.Replacement); ok {
+		gomodPath = filepath.Join(path, "go.mod")
+		// the local repository stands for the requested version
+		if semver.IsValid(b.RevaVersion) {
+			version = b.RevaVersion
+		}
+	} else {
+		d, err := b.w.downloadModule(ctx, b.w.reva, b.RevaVersion)
+		if err != nil {
+			// go get reports the failure
+			b.Log.Debug().Err(err).Msgf("unable to resolve reva %s", b.RevaVersion)
+			return "", nil
+		}
+		gomodPath, version = d.GoMod, d.Version
+	}
+
+	gomod, err := parseGoModFile(ctx, gomodPath)
+	if err != nil {
+		b.Log.Debug().Err(err).Msg("unable to read the requirements of reva")
+		return version, nil
+	}
+	require := make([]string, 0, len(gomod.Require))
+	for _, r := range gomod.Require {
+		require = append(require, r.Path)
+	}
+	return version, require
+}
+
+// moduleOf returns the module providing the given package.
+func moduleOf(modules []Module, pkg string) (Module, bool) {
+	var found Module
+	var ok bool
+	for _, m := range modules {
+		if pkg != m.Path && !strings.HasPrefix(pkg, m.Path+"/") {
+			continue
+		}
+		if !ok || len(m.Path) > len(found.Path) {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+// moduleGraph returns, for each module@version in the module
+// graph of the workspace, the module@version it requires.
+func (w workspace) moduleGraph(ctx context.Context) (map[string][]string, error) {
+	out, err := w.outputGoCommand(ctx, "mod", "graph")
+	if err != nil {
+		return nil, err
+	}
+	graph := make(map[string][]string)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		from, to, ok := strings.Cut(s.Text(), " ")
+		if !ok {
+			continue
+		}
+		graph[from] = append(graph[from], to)
+	}
+	return graph, s.Err()
+}
@@ -0,0 +1,246 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// CToolchain is the C toolchain compiling the cgo code of the build
+// for a platform, e.g. to cross compile the plugins using sqlite.
+type CToolchain struct {
+	// Preset is the built-in toolchain completed, or
+	// overridden, by the other fields, see CToolchainPresets.
+	Preset string `json:"preset,omitempty" toml:"preset,omitempty" yaml:"preset,omitempty"`
+	// CC is the C compiler, with its arguments if any.
+	CC string `json:"cc,omitempty" toml:"cc,omitempty" yaml:"cc,omitempty"`
+	// CXX is the C++ compiler, with its arguments if any.
+	CXX string `json:"cxx,omitempty" toml:"cxx,omitempty" yaml:"cxx,omitempty"`
+	// Sysroot, if set, is the root directory of the headers
+	// and of the libraries of the target platform.
+	Sysroot string `json:"sysroot,omitempty" toml:"sysroot,omitempty" yaml:"sysroot,omitempty"`
+	// ExtLdFlags are the flags passed to the external linker.
+	ExtLdFlags string `json:"extldflags,omitempty" toml:"extldflags,omitempty" yaml:"extldflags,omitempty"`
+	// Tags are the build tags the toolchain needs.
+	Tags []string `json:"tags,omitempty" toml:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+// C toolchain presets
+const (
+	// CToolchainMusl links statically against musl, with musl-gcc
+	// on the host and <arch>-linux-musl-gcc when cross compiling.
+	CToolchainMusl = "musl"
+	// CToolchainZig uses zig cc, linking statically against
+	// musl on linux.
+	CToolchainZig = "zig"
+	// CToolchainZigGnu uses zig cc, linking dynamically
+	// against glibc on linux.
+	CToolchainZigGnu = "zig-gnu"
+)
+
+// CToolchainPresets are the names of the built-in C toolchains.
+var CToolchainPresets = []string{CToolchainMusl, CToolchainZig, CToolchainZigGnu}
+
+// sqlite cannot load extensions when linked statically
+const sqliteStaticTag = "sqlite_omit_load_extension"
+
+// ParseCToolchain parses a C toolchain in the form
+// [os/arch=]preset or [os/arch=]compiler. Without
+// platform, it applies to every platform.
+func ParseCToolchain(s string) (Platform, CToolchain, error) {
+	var p Platform
+	cc := s
+	if platform, rest, ok := strings.Cut(s, "="); ok {
+		var err error
+		if p, err = ParsePlatform(platform); err != nil {
+			return Platform{}, CToolchain{}, err
+		}
+		cc = rest
+	}
+	cc = strings.TrimSpace(cc)
+	if cc == "" {
+		return Platform{}, CToolchain{}, fmt.Errorf("invalid C toolchain %q: expected a preset or a compiler", s)
+	}
+	if slices.Contains(CToolchainPresets, cc) {
+		return p, CToolchain{Preset: cc}, nil
+	}
+	return p, CToolchain{CC: cc}, nil
+}
+
+// cToolchainPreset returns the preset C toolchain for the platform.
+func cToolchainPreset(name string, p, host Platform) (CToolchain, error) {
+	arch, ok := cArchs[p.Arch]
+	if !ok {
+		return CToolchain{}, fmt.Errorf("the %s C toolchain does not support %s", name, p)
+	}
+	switch name {
+	case CToolchainMusl:
+		if p.OS != "linux" {
+			return CToolchain{}, fmt.Errorf("the %s C toolchain only targets linux, not %s", name, p)
+		}
+		tc := CToolchain{Preset: name, CC: "musl-gcc", ExtLdFlags: "-static", Tags: []string{sqliteStaticTag}}
+		if p != host {
+			triple := arch + "-linux-" + linuxABI(p.Arch, "musl")
+			tc.CC, tc.CXX = triple+"-gcc", triple+"-g++"
+		}
+		return tc, nil
+	case CToolchainZig, CToolchainZigGnu:
+		if p.Arch == "386" {
+			arch = "x86"
+		}
+		var target string
+		switch p.OS {
+		case "linux":
+			if name == CToolchainZig {
+				target = arch + "-linux-" + linuxABI(p.Arch, "musl")
+			} else {
+				target = arch + "-linux-" + linuxABI(p.Arch, "gnu")
+			}
+		case "darwin":
+			target = arch + "-macos"
+		case "windows":
+			target = arch + "-windows-gnu"
+		default:
+			return CToolchain{}, fmt.Errorf("the %s C toolchain does not support %s", name, p)
+		}
+		tc := CToolchain{Preset: name, CC: "zig cc -target " + target, CXX: "zig c++ -target " + target}
+		if p.OS == "linux" && name == CToolchainZig {
+			tc.ExtLdFlags = "-static"
+			tc.Tags = []string{sqliteStaticTag}
+		}
+		return tc, nil
+	default:
+		return CToolchain{}, fmt.Errorf("unknown C toolchain preset %q: expected one of %s", name, strings.Join(CToolchainPresets, ", "))
+	}
+}
+
+// cArchs are the architectures of the C target
+// triples of the go architectures.
+var cArchs = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"386":     "i686",
+	"arm":     "arm",
+	"ppc64le": "powerpc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// linuxABI returns the ABI of the C target triple, hard
+// float for arm, as the go toolchain defaults to GOARM=7.
+func linuxABI(arch, libc string) string {
+	if arch == "arm" {
+		return libc + "eabihf"
+	}
+	return libc
+}
+
+// cToolchain returns the C toolchain of the platform, with its preset
+// applied, or nil if the build uses the default one. --static-musl
+// is the musl preset for every platform without a toolchain of its own.
+func (b *Builder) cToolchain(p Platform) (*CToolchain, error) {
+	tc, ok := b.CToolchains[p]
+	if !ok {
+		tc, ok = b.CToolchains[Platform{}]
+	}
+	if !ok && b.StaticMusl {
+		tc, ok = CToolchain{Preset: CToolchainMusl}, true
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	if tc.Preset != "" {
+		preset, err := cToolchainPreset(tc.Preset, p, b.w.host)
+		if err != nil {
+			return nil, err
+		}
+		if tc.CC != "" {
+			preset.CC = tc.CC
+		}
+		if tc.CXX != "" {
+			preset.CXX = tc.CXX
+		}
+		if tc.Sysroot != "" {
+			preset.Sysroot = tc.Sysroot
+		}
+		if tc.ExtLdFlags != "" {
+			preset.ExtLdFlags = tc.ExtLdFlags
+		}
+		for _, tag := range tc.Tags {
+			if !slices.Contains(preset.Tags, tag) {
+				preset.Tags = append(preset.Tags, tag)
+			}
+		}
+		tc = preset
+	}
+	if tc.CC == "" {
+		return nil, fmt.Errorf("no C compiler in the C toolchain of %s", p)
+	}
+	return &tc, nil
+}
+
+// check checks that the C compiler and the sysroot of the toolchain
+// exist. The C++ compiler is only needed by C++ code, and does not
+// come with musl-gcc.
+func (tc *CToolchain) check() error {
+	name := strings.Fields(tc.CC)[0]
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%w: %s not found%s", ErrToolchainNotFound, name, tc.installHint())
+	}
+	if tc.Sysroot != "" {
+		if _, err := os.Stat(tc.Sysroot); err != nil {
+			return fmt.Errorf("%w: sysroot %s not found", ErrToolchainNotFound, tc.Sysroot)
+		}
+	}
+	return nil
+}
+
+// installHint tells how to install the compiler of a preset.
+func (tc *CToolchain) installHint() string {
+	switch {
+	case tc.CC == "musl-gcc":
+		return ". Install with: sudo apt install musl-tools (or equivalent for your distribution)"
+	case tc.Preset == CToolchainMusl:
+		return ". Install a musl cross compiler, e.g. from https://musl.cc"
+	case strings.HasPrefix(tc.CC, "zig "):
+		return ". Install zig from https://ziglang.org/download"
+	default:
+		return ""
+	}
+}
+
+// cgoFlags returns the flags of the C compilers and of the linker,
+// pointing them at the sysroot.
+func (tc *CToolchain) cgoFlags() []string {
+	if tc.Sysroot == "" {
+		return nil
+	}
+	sysroot := "--sysroot=" + tc.Sysroot
+	// the default flags of the go command are replaced
+	return []string{
+		"CGO_CFLAGS=-O2 -g " + sysroot,
+		"CGO_CXXFLAGS=-O2 -g " + sysroot,
+		"CGO_LDFLAGS=-O2 -g " + sysroot,
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DiagnosticKind classifies a failure reported by the go toolchain.
+type DiagnosticKind string
+
+const (
+	DiagnosticUnknownModule    DiagnosticKind = "unknown-module"
+	DiagnosticUnknownRevision  DiagnosticKind = "unknown-revision"
+	DiagnosticChecksumMismatch DiagnosticKind = "checksum-mismatch"
+	DiagnosticCompileError     DiagnosticKind = "compile-error"
+	DiagnosticImportCycle      DiagnosticKind = "import-cycle"
+	DiagnosticIncompatible     DiagnosticKind = "incompatible-plugin"
+	DiagnosticGoVersion        DiagnosticKind = "go-version"
+)
+
+// Diagnostic is a structured description of a failure
+// reported by the go toolchain.
+type Diagnostic struct {
+	Kind     DiagnosticKind `json:"kind"`
+	Module   string         `json:"module,omitempty"`
+	Version  string         `json:"version,omitempty"`
+	Package  string         `json:"package,omitempty"`
+	Position string         `json:"position,omitempty"`
+	// Plugin is the plugin affected by the failure,
+	// empty if it concerns reva or cannot be determined.
+	Plugin  string `json:"plugin,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.Plugin != "" {
+		b.WriteString("plugin " + d.Plugin + ": ")
+	}
+	switch d.Kind {
+	case DiagnosticUnknownModule:
+		b.WriteString("unknown module " + d.Module)
+	case DiagnosticUnknownRevision:
+		b.WriteString("unknown revision " + d.Module + "@" + d.Version)
+	case DiagnosticChecksumMismatch:
+		b.WriteString("checksum mismatch for " + d.Module + "@" + d.Version)
+	case DiagnosticCompileError:
+		b.WriteString("compile error in package " + d.Package)
+		if d.Position != "" {
+			b.WriteString(" at " + d.Position)
+		}
+	case DiagnosticImportCycle:
+		b.WriteString("import cycle through package " + d.Package)
+	case DiagnosticIncompatible:
+		b.WriteString("incompatible with reva")
+	case DiagnosticGoVersion:
+		b.WriteString("go toolchain too old")
+		if d.Module != "" {
+			b.WriteString(" for " + d.Module + "@" + d.Version)
+		}
+	}
+	if d.Message != "" {
+		b.WriteString(": " + d.Message)
+	}
+	return b.String()
+}
+
+// Diagnostics returns the diagnostics attached to the go command
+// failure, or to the failed compatibility check, wrapped in err, if any.
+func Diagnostics(err error) []Diagnostic {
+	var compatErr *CompatibilityError
+	if errors.As(err, &compatErr) {
+		var diags []Diagnostic
+		for _, i := range compatErr.Report.Issues {
+			if i.Severity != CompatError {
+				continue
+			}
+			diags = append(diags, Diagnostic{
+				Kind:    DiagnosticIncompatible,
+				Module:  i.Module,
+				Version: i.Version,
+				Plugin:  i.Plugin,
+				Message: i.Message,
+			})
+		}
+		return diags
+	}
+
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return nil
+	}
+	return cmdErr.Diagnostics
+}
+
+var (
+	reGoModule     = regexp.MustCompile(`^go: (?:module )?([^\s@:]+)(?:@([^\s:]+))?: (.*)$`)
+	reVerifying    = regexp.MustCompile(`verifying ([^\s@:]+)@([^\s:]+?)(?:/go\.mod)?: checksum mismatch`)
+	reMalformed    = regexp.MustCompile(`malformed module path "([^"]+)"`)
+	reNoProvider   = regexp.MustCompile(`(?:no required module provides package|cannot find module providing package) ([^\s;:]+)`)
+	reImportCycle  = regexp.MustCompile(`imports (\S+)(?: from \S+)?: import cycle not allowed`)
+	rePkgHeader    = regexp.MustCompile(`^# (\S+)`)
+	reCompileError = regexp.MustCompile(`^(\S+\.go:\d+(?::\d+)?): (.*)$`)
+	reGoTooOld     = regexp.MustCompile(`(?:([^\s@:]+)@(\S+) )?requires go >= (\S+) \(running go (\S+?);`)
+)
+
+// ParseGoOutput turns the standard error of a go command into
+// diagnostics, attributing each of them to one of the given plugins
+// when possible.
+func ParseGoOutput(stderr string, plugins []Plugin) []Diagnostic {
+	var diags []Diagnostic
+	add := func(d Diagnostic) {
+		d.Plugin = affectedPlugin(d, plugins)
+		if !slices.Contains(diags, d) {
+			diags = append(diags, d)
+		}
+	}
+
+	lines := strings.Split(stderr, "\n")
+	var pkg string // package being compiled
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+
+		// the go command reports details on the following indented lines
+		details := line
+		for i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\t") {
+			details += " " + strings.TrimSpace(lines[i+1])
+			i++
+		}
+
+		if m := rePkgHeader.FindStringSubmatch(line); m != nil {
+			pkg = m[1]
+			continue
+		}
+		if m := reCompileError.FindStringSubmatch(line); m != nil && pkg != "" {
+			add(Diagnostic{Kind: DiagnosticCompileError, Package: pkg, Position: m[1], Message: m[2]})
+			continue
+		}
+		if m := reImportCycle.FindStringSubmatch(details); m != nil {
+			add(Diagnostic{Kind: DiagnosticImportCycle, Package: m[1], Message: "import cycle not allowed"})
+			continue
+		}
+		if m := reGoTooOld.FindStringSubmatch(details); m != nil {
+			msg := fmt.Sprintf("requires go >= %s, the build uses go %s", m[3], m[4])
+			add(Diagnostic{Kind: DiagnosticGoVersion, Module: m[1], Version: m[2], Message: msg})
+			continue
+		}
+		if m := reVerifying.FindStringSubmatch(details); m != nil {
+			add(Diagnostic{Kind: DiagnosticChecksumMismatch, Module: m[1], Version: m[2], Message: "checksum mismatch"})
+			continue
+		}
+		if m := reMalformed.FindStringSubmatch(details); m != nil {
+			add(Diagnostic{Kind: DiagnosticUnknownModule, Module: m[1], Message: "malformed module path"})
+			continue
+		}
+		if m := reNoProvider.FindStringSubmatch(details); m != nil {
+			add(Diagnostic{Kind: DiagnosticUnknownModule, Module: m[1], Message: "no module provides the package"})
+			continue
+		}
+		if m := reGoModule.FindStringSubmatch(details); m != nil {
+			if d, ok := classifyModuleError(m[1], m[2], m[3]); ok {
+				add(d)
+			}
+		}
+	}
+	return diags
+}
+
+// classifyModuleError classifies an error reported by the
+// go command as "go: module@version: message".
+func classifyModuleError(module, version, msg string) (Diagnostic, bool) {
+	version = strings.TrimSuffix(version, "/go.mod")
+	d := Diagnostic{Module: module, Version: version, Message: msg}
+	isQuery := version == "" || version == "latest" || version == "upgrade" || version == "patch"
+	switch {
+	case strings.Contains(msg, "checksum mismatch"):
+		d.Kind = DiagnosticChecksumMismatch
+	case strings.Contains(msg, "unknown revision"),
+		strings.Contains(msg, "invalid version"),
+		strings.Contains(msg, "no matching versions"):
+		d.Kind = DiagnosticUnknownRevision
+	case strings.Contains(msg, "unrecognized import path"),
+		strings.Contains(msg, "repository not found"),
+		strings.Contains(msg, "Repository not found"),
+		strings.Contains(msg, "ls-remote"):
+		d.Kind = DiagnosticUnknownModule
+	case strings.Contains(msg, "not found"),
+		strings.Contains(msg, "not available"),
+		strings.Contains(msg, "404"),
+		strings.Contains(msg, "410"):
+		// the proxy does not know this version: if a specific
+		// one was asked it is the revision that is missing
+		if isQuery {
+			d.Kind = DiagnosticUnknownModule
+		} else {
+			d.Kind = DiagnosticUnknownRevision
+		}
+	default:
+		return Diagnostic{}, false
+	}
+	return d, true
+}
+
+// attributeDependencies attributes the diagnostics about a module, or one
+// of its packages, that no plugin provides to the first plugin requiring
+// it, directly or not, in the module graph of the workspace.
+func attributeDependencies(diags []Diagnostic, graph map[string][]string, plugins []Plugin) []Diagnostic {
+	var nodes []string
+	for from, to := range graph {
+		nodes = append(nodes, from)
+		nodes = append(nodes, to...)
+	}
+	// providers returns the nodes of the module providing the package,
+	// the longest module path containing it, at the version if given
+	providers := func(pkg, version string) []string {
+		var found []string
+		var path string
+		for _, n := range nodes {
+			p, v, _ := strings.Cut(n, "@")
+			if pkg != p && !strings.HasPrefix(pkg, p+"/") || version != "" && v != version {
+				continue
+			}
+			switch {
+			case len(p) > len(path):
+				found, path = []string{n}, p
+			case p == path && !slices.Contains(found, n):
+				found = append(found, n)
+			}
+		}
+		return found
+	}
+
+	out := slices.Clone(diags)
+	for i, d := range out {
+		pkg := d.Package
+		if pkg == "" {
+			pkg = d.Module
+		}
+		if d.Plugin != "" || pkg == "" {
+			continue
+		}
+		version := d.Version
+		if d.Package != "" {
+			version = ""
+		}
+		targets := providers(pkg, version)
+		if len(targets) == 0 {
+			continue
+		}
+		for _, p := range plugins {
+			if isRevaModule(p.RepositoryPath) {
+				continue
+			}
+			if requires(graph, providers(p.RepositoryPath, ""), targets) {
+				out[i].Plugin = p.RepositoryPath
+				break
+			}
+		}
+	}
+	return out
+}
+
+// requires returns true if one of the targets can be
+// reached from one of the nodes in the module graph.
+func requires(graph map[string][]string, from, targets []string) bool {
+	seen := make(map[string]bool)
+	queue := slices.Clone(from)
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		if slices.Contains(targets, n) {
+			return true
+		}
+		queue = append(queue, graph[n]...)
+	}
+	return false
+}
+
+// affectedPlugin returns the plugin the diagnostic refers to,
+// that is the plugin whose path is the longest one containing,
+// or contained in, the package or the module of the diagnostic.
+func affectedPlugin(d Diagnostic, plugins []Plugin) string {
+	path := d.Package
+	if path == "" {
+		path = d.Module
+	}
+	if path == "" {
+		return ""
+	}
+	var found string
+	for _, p := range plugins {
+		r := p.RepositoryPath
+		if isRevaModule(r) {
+			continue
+		}
+		related := path == r || strings.HasPrefix(path, r+"/") || strings.HasPrefix(r, path+"/")
+		if related && len(r) > len(found) {
+			found = r
+		}
+	}
+	return found
+}
@@ -0,0 +1,199 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAttributeDependencies(t *testing.T) {
+	graph := map[string][]string{
+		"revad": {
+			"github.com/cs3org/reva/v3@v3.0.1",
+			"example.org/a@v1.0.0",
+			"example.org/b@v1.2.0",
+		},
+		"github.com/cs3org/reva/v3@v3.0.1": {"example.org/shared@v1.0.0"},
+		"example.org/a@v1.0.0":             {"example.org/lib@v1.1.0"},
+		"example.org/b@v1.2.0":             {"example.org/util@v0.3.0"},
+		"example.org/util@v0.3.0":          {"example.org/lib/v2@v2.0.0", "example.org/lib@v1.0.0"},
+		"example.org/lib@v1.1.0":           {"example.org/shared@v1.0.0"},
+		"example.org/unrelated@v0.1.0":     nil,
+	}
+	plugins := []Plugin{
+		{RepositoryPath: "github.com/cs3org/reva/v3", Version: "v3.0.1"},
+		{RepositoryPath: "example.org/a", Version: "v1.0.0"},
+		{RepositoryPath: "example.org/b/plugin", Version: "v1.2.0"},
+	}
+
+	tests := []struct {
+		name string
+		diag Diagnostic
+		want string
+	}{
+		{
+			name: "module required by a plugin",
+			diag: Diagnostic{Kind: DiagnosticChecksumMismatch, Module: "example.org/lib", Version: "v1.1.0"},
+			want: "example.org/a",
+		},
+		{
+			name: "module required through another module",
+			diag: Diagnostic{Kind: DiagnosticGoVersion, Module: "example.org/lib/v2", Version: "v2.0.0"},
+			want: "example.org/b/plugin",
+		},
+		{
+			name: "package of a dependency",
+			diag: Diagnostic{Kind: DiagnosticCompileError, Package: "example.org/lib/v2/internal/x"},
+			want: "example.org/b/plugin",
+		},
+		{
+			name: "module required by a plugin and reva",
+			diag: Diagnostic{Kind: DiagnosticChecksumMismatch, Module: "example.org/shared", Version: "v1.0.0"},
+			want: "example.org/a",
+		},
+		{
+			name: "version required by another plugin",
+			diag: Diagnostic{Kind: DiagnosticChecksumMismatch, Module: "example.org/lib", Version: "v1.0.0"},
+			want: "example.org/b/plugin",
+		},
+		{
+			name: "module required by no plugin",
+			diag: Diagnostic{Kind: DiagnosticChecksumMismatch, Module: "example.org/unrelated", Version: "v0.1.0"},
+		},
+		{
+			name: "module not in the graph",
+			diag: Diagnostic{Kind: DiagnosticUnknownModule, Module: "example.org/missing"},
+		},
+		{
+			name: "already attributed",
+			diag: Diagnostic{Kind: DiagnosticCompileError, Package: "example.org/lib", Plugin: "example.org/b/plugin"},
+			want: "example.org/b/plugin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := attributeDependencies([]Diagnostic{tt.diag}, graph, plugins)
+			if got[0].Plugin != tt.want {
+				t.Errorf("plugin = %q, want %q", got[0].Plugin, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGoOutput(t *testing.T) {
+	plugins := []Plugin{
+		{RepositoryPath: "github.com/cs3org/reva/v3", Version: "v3.0.1"},
+		{RepositoryPath: "example.org/plugin", Version: "v1.0.0"},
+		{RepositoryPath: "example.org/repo/plugins/x", Version: "v0.2.0"},
+	}
+	tests := []struct {
+		name   string
+		stderr string
+		want   []Diagnostic
+	}{
+		{
+			name:   "unknown revision",
+			stderr: "go: example.org/plugin@v9.9.9: invalid version: unknown revision v9.9.9",
+			want: []Diagnostic{{Kind: DiagnosticUnknownRevision, Module: "example.org/plugin", Version: "v9.9.9",
+				Message: "invalid version: unknown revision v9.9.9", Plugin: "example.org/plugin"}},
+		},
+		{
+			name:   "version missing from the proxy",
+			stderr: "go: example.org/plugin@v1.4.0: reading https://proxy.golang.org/example.org/plugin/@v/v1.4.0.info: 404 Not Found",
+			want: []Diagnostic{{Kind: DiagnosticUnknownRevision, Module: "example.org/plugin", Version: "v1.4.0",
+				Message: "reading https://proxy.golang.org/example.org/plugin/@v/v1.4.0.info: 404 Not Found", Plugin: "example.org/plugin"}},
+		},
+		{
+			name:   "module missing from the proxy",
+			stderr: "go: example.org/nope@latest: reading https://proxy.golang.org/example.org/nope/@v/list: 404 Not Found",
+			want: []Diagnostic{{Kind: DiagnosticUnknownModule, Module: "example.org/nope", Version: "latest",
+				Message: "reading https://proxy.golang.org/example.org/nope/@v/list: 404 Not Found"}},
+		},
+		{
+			name:   "unrecognized import path",
+			stderr: "go: example.org/repo/plugins/x@v0.2.0: unrecognized import path \"example.org/repo\"",
+			want: []Diagnostic{{Kind: DiagnosticUnknownModule, Module: "example.org/repo/plugins/x", Version: "v0.2.0",
+				Message: "unrecognized import path \"example.org/repo\"", Plugin: "example.org/repo/plugins/x"}},
+		},
+		{
+			name: "checksum mismatch",
+			stderr: "verifying example.org/lib@v1.1.0/go.mod: checksum mismatch\n" +
+				"\tdownloaded: h1:aaa=\n\tgo.sum:     h1:bbb=",
+			want: []Diagnostic{{Kind: DiagnosticChecksumMismatch, Module: "example.org/lib", Version: "v1.1.0", Message: "checksum mismatch"}},
+		},
+		{
+			name: "compile errors",
+			stderr: "# example.org/repo/plugins/x/storage\n" +
+				"../storage/fs.go:12:2: undefined: foo\n" +
+				"../storage/fs.go:20:9: too many return values\n" +
+				"# example.org/plugin\n" +
+				"plugin.go:3:8: \"os\" imported and not used",
+			want: []Diagnostic{
+				{Kind: DiagnosticCompileError, Package: "example.org/repo/plugins/x/storage", Position: "../storage/fs.go:12:2",
+					Message: "undefined: foo", Plugin: "example.org/repo/plugins/x"},
+				{Kind: DiagnosticCompileError, Package: "example.org/repo/plugins/x/storage", Position: "../storage/fs.go:20:9",
+					Message: "too many return values", Plugin: "example.org/repo/plugins/x"},
+				{Kind: DiagnosticCompileError, Package: "example.org/plugin", Position: "plugin.go:3:8",
+					Message: "\"os\" imported and not used", Plugin: "example.org/plugin"},
+			},
+		},
+		{
+			name:   "import cycle",
+			stderr: "package revad\n\timports example.org/plugin\n\timports example.org/plugin/sub: import cycle not allowed",
+			want: []Diagnostic{{Kind: DiagnosticImportCycle, Package: "example.org/plugin/sub", Message: "import cycle not allowed",
+				Plugin: "example.org/plugin"}},
+		},
+		{
+			name:   "go too old",
+			stderr: "go: example.org/plugin@v1.0.0 requires go >= 1.99 (running go 1.22.5; GOTOOLCHAIN=local)",
+			want: []Diagnostic{{Kind: DiagnosticGoVersion, Module: "example.org/plugin", Version: "v1.0.0",
+				Message: "requires go >= 1.99, the build uses go 1.22.5", Plugin: "example.org/plugin"}},
+		},
+		{
+			name:   "no module provides the package",
+			stderr: "main.go:5:2: no required module provides package example.org/plugin/missing; to add it:\n\tgo get example.org/plugin/missing",
+			want: []Diagnostic{{Kind: DiagnosticUnknownModule, Module: "example.org/plugin/missing", Message: "no module provides the package",
+				Plugin: "example.org/plugin"}},
+		},
+		{
+			name:   "malformed module path",
+			stderr: "go: malformed module path \"plugin\": missing dot in first path element",
+			want:   []Diagnostic{{Kind: DiagnosticUnknownModule, Module: "plugin", Message: "malformed module path"}},
+		},
+		{
+			name:   "same failure twice",
+			stderr: "go: example.org/plugin@v9.9.9: invalid version: unknown revision v9.9.9\ngo: example.org/plugin@v9.9.9: invalid version: unknown revision v9.9.9",
+			want: []Diagnostic{{Kind: DiagnosticUnknownRevision, Module: "example.org/plugin", Version: "v9.9.9",
+				Message: "invalid version: unknown revision v9.9.9", Plugin: "example.org/plugin"}},
+		},
+		{
+			name:   "nothing to classify",
+			stderr: "go: downloading example.org/plugin v1.0.0\ngo: added example.org/plugin v1.0.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseGoOutput(tt.stderr, plugins)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParseGoOutput() =\n\t%+v\nwant\n\t%+v", got, tt.want)
+			}
+		})
+	}
+}
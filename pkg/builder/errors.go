@@ -0,0 +1,160 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import "errors"
+
+var (
+	// ErrToolchainNotFound is returned when the go toolchain,
+	// or a required C compiler, is not available.
+	ErrToolchainNotFound = errors.New("toolchain not found")
+
+	// ErrVersionNotFound is returned when the requested
+	// version of reva or of a plugin does not exist.
+	ErrVersionNotFound = errors.New("version not found")
+
+	// ErrIncompatiblePlugins is returned when the plugins
+	// cannot be built with the requested version of reva.
+	ErrIncompatiblePlugins = errors.New("incompatible plugins")
+)
+
+// CommandError is returned when a go command fails.
+type CommandError struct {
+	Args   []string
+	Stderr string
+	Err    error
+	// Diagnostics classifies the failures found in Stderr.
+	Diagnostics []Diagnostic
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ": " + e.Stderr
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// ModuleFetchError is returned when a module
+// cannot be added to the workspace.
+type ModuleFetchError struct {
+	Module  string
+	Version string
+	Err     error
+}
+
+func (e *ModuleFetchError) Error() string {
+	m := e.Module
+	if e.Version != "" {
+		m += "@" + e.Version
+	}
+	return "error fetching module " + m + ": " + e.Err.Error()
+}
+
+func (e *ModuleFetchError) Unwrap() error { return e.Err }
+
+// Is reports whether the fetch failed because the
+// requested module or version does not exist.
+func (e *ModuleFetchError) Is(target error) bool {
+	if target != ErrVersionNotFound {
+		return false
+	}
+	for _, d := range Diagnostics(e.Err) {
+		if d.Kind == DiagnosticUnknownRevision || d.Kind == DiagnosticUnknownModule {
+			return true
+		}
+	}
+	return false
+}
+
+// CompileError is returned when the compilation of reva fails.
+type CompileError struct {
+	Platform Platform
+	// Target is the name of the target, empty for revad.
+	Target string
+	Err    error
+}
+
+func (e *CompileError) Error() string {
+	what := "reva"
+	if e.Target != "" && e.Target != DefaultTarget.Name {
+		what = e.Target
+	}
+	return "error compiling " + what + " for " + e.Platform.String() + ": " + e.Err.Error()
+}
+
+func (e *CompileError) Unwrap() error { return e.Err }
+
+// HookError is returned when a hook fails, aborting the build.
+type HookError struct {
+	Point HookPoint
+	Hook  string
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	return "hook " + e.Hook + " failed: " + e.Err.Error()
+}
+
+func (e *HookError) Unwrap() error { return e.Err }
+
+// CompatibilityError is returned by Prepare when the
+// compatibility check of the plugins finds errors.
+type CompatibilityError struct {
+	Report *CompatReport
+}
+
+func (e *CompatibilityError) Error() string {
+	return e.Report.String()
+}
+
+func (e *CompatibilityError) Is(target error) bool {
+	return target == ErrIncompatiblePlugins
+}
+
+// TemplateError is returned when the main.go template
+// cannot be rendered, or renders an invalid program.
+type TemplateError struct {
+	Template string
+	Err      error
+}
+
+func (e *TemplateError) Error() string {
+	return "error in the " + e.Template + " main.go template: " + e.Err.Error()
+}
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+// ToolchainMismatchError is returned when the go toolchain
+// found for the requested go version reports another one.
+type ToolchainMismatchError struct {
+	Want string
+	Got  string
+	// Go is the go command that was run.
+	Go string
+}
+
+func (e *ToolchainMismatchError) Error() string {
+	return "go " + e.Want + " was requested, but " + e.Go + " is go " + e.Got
+}
+
+func (e *ToolchainMismatchError) Is(target error) bool {
+	return target == ErrToolchainNotFound
+}
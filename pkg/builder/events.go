@@ -0,0 +1,223 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventSink receives the events of a build as they happen.
+// The platforms are built in parallel, so Event must be
+// safe for concurrent use.
+type EventSink interface {
+	Event(Event)
+}
+
+// EventSinkFunc adapts a function to an EventSink.
+type EventSinkFunc func(Event)
+
+// Event calls f(e).
+func (f EventSinkFunc) Event(e Event) { f(e) }
+
+// EventType is the type of a build event.
+type EventType string
+
+const (
+	// EventStageStarted is sent when a stage of the build starts.
+	EventStageStarted EventType = "stage_started"
+	// EventStageFinished is sent when a stage of the build ends,
+	// with its duration and its error if it failed.
+	EventStageFinished EventType = "stage_finished"
+	// EventFetchStarted is sent when a plugin starts being fetched.
+	EventFetchStarted EventType = "fetch_started"
+	// EventFetchFinished is sent when a plugin has been fetched,
+	// with the duration of the fetch and its error if it failed.
+	EventFetchFinished EventType = "fetch_finished"
+	// EventOutput is a line written by a go command.
+	EventOutput EventType = "output"
+)
+
+// Stage is a stage of the build.
+type Stage string
+
+const (
+	// StageInit creates the module of the workspace and its main packages.
+	StageInit Stage = "init"
+	// StageReplace applies the replacements of the modules.
+	StageReplace Stage = "replace"
+	// StageGet adds reva and the plugins to the module.
+	StageGet Stage = "get"
+	// StageTidy resolves all the modules.
+	StageTidy Stage = "tidy"
+	// StageVendor copies the modules into the workspace.
+	StageVendor Stage = "vendor"
+	// StageCompile compiles a target for a platform.
+	StageCompile Stage = "compile"
+)
+
+// Event is an event of a build. Only the fields
+// relevant to its type are set.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Stage is the stage of the event, also
+	// for the output of the go commands.
+	Stage Stage `json:"stage,omitempty"`
+	// Platform and Target are those compiled.
+	Platform string `json:"platform,omitempty"`
+	Target   string `json:"target,omitempty"`
+	// Output is the binary the target is compiled to.
+	Output string `json:"output,omitempty"`
+	// Plugin is the plugin fetched, the Index-th of Total.
+	Plugin string `json:"plugin,omitempty"`
+	Index  int    `json:"index,omitempty"`
+	Total  int    `json:"total,omitempty"`
+	// Line is a line of the output of a go command.
+	Line string `json:"line,omitempty"`
+	// Duration is the duration of the stage or of the fetch.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Error is the error of the stage or of the fetch.
+	Error string `json:"error,omitempty"`
+}
+
+// emit sends the event to the sink of the builder, if any.
+func (b *Builder) emit(e Event) {
+	if b.Events == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.Events.Event(e)
+}
+
+type eventKey struct{}
+
+// runStage runs the stage between its pre and post hooks, sending
+// its start and its end. The output of the go commands run with the
+// context it is given, and of the hooks, is attributed to the stage.
+func (b *Builder) runStage(ctx context.Context, e Event, run func(context.Context) error) error {
+	e.Type = EventStageStarted
+	b.emit(e)
+	started := time.Now()
+	ctx = context.WithValue(ctx, eventKey{}, e)
+	err := b.runHooks(ctx, PreStage(e.Stage), e)
+	if err == nil {
+		err = run(ctx)
+	}
+	if err == nil {
+		err = b.runHooks(ctx, PostStage(e.Stage), e)
+	}
+	e.Type = EventStageFinished
+	e.Time = time.Now()
+	e.Duration = e.Time.Sub(started)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b.emit(e)
+	return err
+}
+
+// fetchPlugin fetches the index-th of the total plugins into the workspace.
+func (b *Builder) fetchPlugin(ctx context.Context, plugin Plugin, index, total int) error {
+	e := Event{Type: EventFetchStarted, Stage: StageGet, Plugin: plugin.String(), Index: index, Total: total}
+	b.emit(e)
+	started := time.Now()
+	err := b.w.runGoGetCommand(ctx, plugin.RepositoryPath, b.pluginVersion(plugin))
+	e.Type = EventFetchFinished
+	e.Time = time.Now()
+	e.Duration = e.Time.Sub(started)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b.emit(e)
+	return err
+}
+
+// goCommandStderr returns the writer of the standard error of a go
+// command, also sent as output events, and the function flushing it
+// once the command ended.
+func (w workspace) goCommandStderr(ctx context.Context, buf *strings.Builder) (io.Writer, func()) {
+	out := w.newOutputWriter(ctx)
+	if out == nil {
+		return buf, func() {}
+	}
+	return io.MultiWriter(buf, out), out.Flush
+}
+
+// outputWriter sends each line written to it as
+// an output event of the stage of the context.
+type outputWriter struct {
+	sink  EventSink
+	stage Event
+	mu    sync.Mutex
+	buf   []byte
+}
+
+// newOutputWriter returns the writer of the output of the go commands
+// run with the context, nil if there is no sink.
+func (w workspace) newOutputWriter(ctx context.Context) *outputWriter {
+	if w.events == nil {
+		return nil
+	}
+	stage, _ := ctx.Value(eventKey{}).(Event)
+	return &outputWriter{sink: w.events, stage: stage}
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.buf = append(o.buf, p...)
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+		o.send(string(bytes.TrimRight(o.buf[:i], "\r")))
+		o.buf = o.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush sends the last line, if not terminated by a newline.
+func (o *outputWriter) Flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.buf) != 0 {
+		o.send(string(o.buf))
+		o.buf = nil
+	}
+}
+
+func (o *outputWriter) send(line string) {
+	o.sink.Event(Event{
+		Type:     EventOutput,
+		Time:     time.Now(),
+		Stage:    o.stage.Stage,
+		Platform: o.stage.Platform,
+		Target:   o.stage.Target,
+		Output:   o.stage.Output,
+		Line:     line,
+	})
+}
@@ -21,13 +21,18 @@ package builder
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
 	"net/http"
+	"os"
 	"os/exec"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/cs3org/gaia/internal/utils"
+	"golang.org/x/mod/module"
 )
 
 type buildArgs map[string][]string
@@ -41,7 +46,9 @@ func formatOptionArgument(vals []string) string {
 }
 
 func (b buildArgs) Format() (args []string) {
-	for k, vals := range b {
+	// sorted, so that the same build always gets the same arguments
+	for _, k := range slices.Sorted(maps.Keys(b)) {
+		vals := b[k]
 		args = append(args, k)
 		if optArgs := formatOptionArgument(vals); optArgs != "" {
 			args = append(args, optArgs)
@@ -57,40 +64,31 @@ type buildFlags struct {
 	BuildDate time.Time
 }
 
-const buildVariablesPkg = revaRepository + "/cmd/revad"
-
 func generateBuildFlag(key, val string) string {
 	return "-X " + key + "=" + val
 }
 
-func (b buildFlags) Format() string {
+// Format returns the ldflags setting the version variables in each of
+// the given packages. The linker ignores the packages not built.
+func (b buildFlags) Format(pkgs ...string) string {
 	var params []string
-	if b.GitCommit != "" {
-		params = append(params, generateBuildFlag(buildVariablesPkg+".gitCommit", b.GitCommit))
-	}
-	if b.Version != "" {
-		params = append(params, generateBuildFlag(buildVariablesPkg+".version", b.Version))
-	}
-	if b.GoVersion != "" {
-		params = append(params, generateBuildFlag(buildVariablesPkg+".goVersion", b.GoVersion))
-	}
-	if b.BuildDate.Unix() != 0 {
-		params = append(params, generateBuildFlag(buildVariablesPkg+".buildDate", b.BuildDate.Format(time.RFC3339)))
+	for _, pkg := range pkgs {
+		if b.GitCommit != "" {
+			params = append(params, generateBuildFlag(pkg+".gitCommit", b.GitCommit))
+		}
+		if b.Version != "" {
+			params = append(params, generateBuildFlag(pkg+".version", b.Version))
+		}
+		if b.GoVersion != "" {
+			params = append(params, generateBuildFlag(pkg+".goVersion", b.GoVersion))
+		}
+		if b.BuildDate.Unix() != 0 {
+			params = append(params, generateBuildFlag(pkg+".buildDate", b.BuildDate.Format(time.RFC3339)))
+		}
 	}
 	return strings.Join(params, " ")
 }
 
-func getGoVersion() string {
-	var b strings.Builder
-	cmd := exec.Command(utils.Go(), "version")
-	cmd.Stdout = &b
-	if err := cmd.Run(); err != nil {
-		panic(err)
-	}
-	s := strings.Split(b.String(), " ")
-	return strings.TrimPrefix(s[2], "go")
-}
-
 type Module struct {
 	Path      string    `json:"Path"`
 	Version   string    `json:"Version"`
@@ -99,35 +97,46 @@ type Module struct {
 	Dir       string    `json:"Dir"`
 	GoMod     string    `json:"GoMod"`
 	GoVersion string    `json:"GoVersion"`
+	Main      bool      `json:"Main"`
+	Replace   *Module   `json:"Replace"`
 }
 
-func getRevaVersion(w *workspace, replacements []Replace) string {
+func getRevaVersion(ctx context.Context, w *workspace, replacements []Replace) (string, error) {
 	// we assume here that the reva repository is already available
 	// in the current go mod
-	if path, ok := isRevaLocalReplacement(replacements); ok {
+	if path, ok := isRevaLocalReplacement(w.reva, replacements); ok {
 		var b strings.Builder
-		cmd := exec.Command("git", "describe", "--always")
+		cmd := exec.CommandContext(ctx, "git", "describe", "--always")
 		cmd.Dir = path
 		cmd.Stdout = &b
 		if err := cmd.Run(); err != nil {
-			panic(err)
+			return "", fmt.Errorf("error describing local reva repository: %w", err)
 		}
-		return strings.TrimSpace(b.String())
+		return strings.TrimSpace(b.String()), nil
 	}
 
-	var b strings.Builder
-	cmd := w.newGoCommand(context.Background(), nil, "list", "-m", "-json", revaRepository)
-	cmd.Stdout = &b
-	if err := cmd.Run(); err != nil {
-		panic(err)
+	out, err := w.outputGoCommand(ctx, "list", "-m", "-json", w.reva)
+	if err != nil {
+		if isUnknownVersion(err) {
+			return "", fmt.Errorf("%w: %w", ErrVersionNotFound, err)
+		}
+		return "", err
 	}
 
 	var m Module
-	if err := json.NewDecoder(strings.NewReader(b.String())).Decode(&m); err != nil {
-		panic(err)
+	if err := json.Unmarshal(out, &m); err != nil {
+		return "", fmt.Errorf("error decoding module %s: %w", w.reva, err)
 	}
 
-	return m.Version
+	return m.Version, nil
+}
+
+// isUnknownVersion returns true if the go command failed
+// because the module or its version does not exist.
+func isUnknownVersion(err error) bool {
+	return slices.ContainsFunc(Diagnostics(err), func(d Diagnostic) bool {
+		return d.Kind == DiagnosticUnknownModule || d.Kind == DiagnosticUnknownRevision
+	})
 }
 
 type GithubRef struct {
@@ -141,66 +150,265 @@ type GithubRef struct {
 	} `json:"object"`
 }
 
-func getGitCommit(version string, replacements []Replace) string {
-	if path, ok := isRevaLocalReplacement(replacements); ok {
+// ModuleInfo is the content of the .info file
+// stored in the module cache for a module version.
+type ModuleInfo struct {
+	Version string    `json:"Version"`
+	Time    time.Time `json:"Time"`
+	Origin  *struct {
+		VCS  string `json:"VCS"`
+		URL  string `json:"URL"`
+		Ref  string `json:"Ref"`
+		Hash string `json:"Hash"`
+	} `json:"Origin"`
+}
+
+// ErrCommitNotFound is returned when the commit
+// of a reva version cannot be determined.
+var ErrCommitNotFound = errors.New("git commit not found")
+
+const shortCommitLen = 9
+
+func shortCommit(hash string) string {
+	if len(hash) > shortCommitLen {
+		return hash[:shortCommitLen]
+	}
+	return hash
+}
+
+// getGitCommit resolves the git commit of the given reva version.
+// It first looks at the information available locally (local replacement,
+// pseudo-version, module cache), then, unless offline, asks GitHub when
+// reva, or the module replacing it, is hosted there. The module zips are
+// of no help: the go command leaves the VCS metadata out of them.
+func (w *workspace) getGitCommit(ctx context.Context, version string, replacements []Replace, offline bool) (string, error) {
+	if path, ok := isRevaLocalReplacement(w.reva, replacements); ok {
 		// TODO (gdelmont): is the repository is dirty, this is not actually true
 		// we can mark the git commit as "dirty", like "4bbe83eec (*dirty*)"
 		var b strings.Builder
-		cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+		cmd := exec.CommandContext(ctx, "git", "rev-parse", "--short", "HEAD")
 		cmd.Dir = path
 		cmd.Stdout = &b
 		if err := cmd.Run(); err != nil {
-			panic(err)
+			return "", fmt.Errorf("error getting commit of local reva repository: %w", err)
 		}
-		return strings.TrimSpace(b.String())
+		return strings.TrimSpace(b.String()), nil
+	}
+
+	path, version := w.revaSource(version, replacements)
+
+	// pseudo-versions already carry the commit
+	if module.IsPseudoVersion(version) {
+		if rev, err := module.PseudoVersionRev(version); err == nil {
+			return shortCommit(rev), nil
+		}
+	}
+
+	// the module proxy records the origin of the module in the
+	// .info file, that is kept in the module cache
+	info, err := w.getModuleInfo(ctx, path, version)
+	if err == nil && info.Origin != nil && info.Origin.Hash != "" {
+		return shortCommit(info.Origin.Hash), nil
+	}
+	if err != nil {
+		w.log.Debug().Err(err).Msg("commit not available in the module cache")
+	}
+
+	if offline {
+		return "", ErrCommitNotFound
 	}
 
 	// this information is not in the cached go module
 	// we need to retrieve this information from github
-	url := "https://api.github.com/repos/cs3org/reva/git/refs/tags/" + version
-	res, err := http.Get(url)
-	if err != nil {
-		panic(err)
+	repo, ok := githubRepo(path)
+	if !ok {
+		return "", ErrCommitNotFound
 	}
-	defer res.Body.Close()
-	if res.StatusCode == http.StatusOK {
-		var tag GithubRef
-		if err := json.NewDecoder(res.Body).Decode(&tag); err != nil {
-			panic(err)
+	for _, ref := range []string{"tags/" + version, "heads/" + version} {
+		sha, err := getGithubRef(ctx, repo, ref)
+		if err != nil {
+			return "", err
+		}
+		if sha != "" {
+			return shortCommit(sha), nil
+		}
+	}
+	return "", ErrCommitNotFound
+}
+
+// revaSource returns the module and version of the code built
+// for the given reva version: the ones of the module reva is
+// replaced with, if any, as the code built is the one of it.
+func (w *workspace) revaSource(version string, replacements []Replace) (string, string) {
+	path := w.reva
+	for _, r := range replacements {
+		if r.From == w.reva && r.ToVersion != "" {
+			path, version = r.To, r.ToVersion
+		}
+	}
+	return path, version
+}
+
+// githubRepo returns the owner/repo of a module hosted on GitHub.
+func githubRepo(path string) (string, bool) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[0] != "github.com" {
+		return "", false
+	}
+	return parts[1] + "/" + parts[2], true
+}
+
+// moduleDownload is the description of a module
+// version given by go mod download -json.
+type moduleDownload struct {
+	Path    string `json:"Path"`
+	Version string `json:"Version"`
+	Info    string `json:"Info"`
+	GoMod   string `json:"GoMod"`
+	Dir     string `json:"Dir"`
+	Error   string `json:"Error"`
+}
+
+// downloadModule downloads the given module version, if not
+// already in the module cache, resolving version queries.
+func (w *workspace) downloadModule(ctx context.Context, path, version string) (*moduleDownload, error) {
+	out, err := w.outputGoCommand(ctx, "mod", "download", "-json", path+"@"+version)
+	var d moduleDownload
+	if jsonErr := json.Unmarshal(out, &d); jsonErr != nil {
+		if err != nil {
+			return nil, err
 		}
-		return tag.Object.Sha[:9]
+		return nil, jsonErr
+	}
+	if d.Error != "" {
+		return nil, errors.New(d.Error)
+	}
+	return &d, nil
+}
+
+// getModuleInfo returns the .info file of the given module version,
+// downloading it if not already in the module cache.
+func (w *workspace) getModuleInfo(ctx context.Context, path, version string) (*ModuleInfo, error) {
+	d, err := w.downloadModule(ctx, path, version)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(d.Info)
+	if err != nil {
+		return nil, err
+	}
+	var info ModuleInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", d.Info, err)
 	}
+	return &info, nil
+}
 
-	// Maybe we got a branch...
-	url = "https://api.github.com/repos/cs3org/reva/git/refs/heads/" + version
-	res, err = http.Get(url)
+// getGithubRef returns the sha the given ref points to in a GitHub
+// repository, or an empty string if the ref does not exist.
+func getGithubRef(ctx context.Context, repo, ref string) (string, error) {
+	url := "https://api.github.com/repos/" + repo + "/git/refs/" + ref
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		panic(err)
+		return "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error querying github: %w", err)
 	}
 	defer res.Body.Close()
-	if res.StatusCode == http.StatusOK {
-		var tag GithubRef
-		if err := json.NewDecoder(res.Body).Decode(&tag); err != nil {
-			panic(err)
-		}
-		return tag.Object.Sha[:9]
+	if res.StatusCode != http.StatusOK {
+		return "", nil
 	}
+	var tag GithubRef
+	if err := json.NewDecoder(res.Body).Decode(&tag); err != nil {
+		return "", fmt.Errorf("error decoding github ref: %w", err)
+	}
+	return tag.Object.Sha, nil
+}
+
+// SourceDateEpochEnv is the environment variable that, following
+// https://reproducible-builds.org/specs/source-date-epoch/, sets
+// the build date of reproducible builds.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
 
-	// Maybe we got the sha already...
-	// Not worth checking
-	return version
+// getBuildDate returns the build date stored in the binary.
+// Reproducible builds cannot use the current time: the date is
+// taken from SOURCE_DATE_EPOCH if set, otherwise from the date of
+// the reva commit.
+func (w *workspace) getBuildDate(ctx context.Context, version string, replacements []Replace, reproducible bool) (time.Time, error) {
+	if !reproducible {
+		return time.Now(), nil
+	}
+	if epoch := os.Getenv(SourceDateEpochEnv); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s %q: %w", SourceDateEpochEnv, epoch, err)
+		}
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	date, err := w.getCommitDate(ctx, version, replacements)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting the date of reva %s, set %s to build reproducibly: %w", version, SourceDateEpochEnv, err)
+	}
+	return date.UTC(), nil
 }
 
-func getBuildDate() time.Time {
-	return time.Now()
+// getCommitDate returns the date of the commit of the given reva version.
+func (w *workspace) getCommitDate(ctx context.Context, version string, replacements []Replace) (time.Time, error) {
+	if path, ok := isRevaLocalReplacement(w.reva, replacements); ok {
+		var b strings.Builder
+		cmd := exec.CommandContext(ctx, "git", "log", "-1", "--format=%ct", "HEAD")
+		cmd.Dir = path
+		cmd.Stdout = &b
+		if err := cmd.Run(); err != nil {
+			return time.Time{}, fmt.Errorf("error getting commit date of local reva repository: %w", err)
+		}
+		sec, err := strconv.ParseInt(strings.TrimSpace(b.String()), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error parsing commit date of local reva repository: %w", err)
+		}
+		return time.Unix(sec, 0), nil
+	}
+
+	path, version := w.revaSource(version, replacements)
+
+	// pseudo-versions already carry the commit date
+	if module.IsPseudoVersion(version) {
+		if t, err := module.PseudoVersionTime(version); err == nil {
+			return t, nil
+		}
+	}
+
+	// for tags, the module cache records the commit date
+	info, err := w.getModuleInfo(ctx, path, version)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.Time.IsZero() {
+		return time.Time{}, fmt.Errorf("no date recorded for %s@%s", path, version)
+	}
+	return info.Time, nil
 }
 
-func (w *workspace) generateBuildFlags(replacements []Replace) buildFlags {
-	version := getRevaVersion(w, replacements)
+func (w *workspace) generateBuildFlags(ctx context.Context, replacements []Replace, offline, reproducible bool) (buildFlags, error) {
+	version, err := getRevaVersion(ctx, w, replacements)
+	if err != nil {
+		return buildFlags{}, err
+	}
+	commit, err := w.getGitCommit(ctx, version, replacements, offline)
+	if err != nil {
+		// the commit is only informative, the build can go on without it
+		w.log.Warn().Err(err).Msgf("unable to determine the git commit of reva %s", version)
+	}
+	buildDate, err := w.getBuildDate(ctx, version, replacements, reproducible)
+	if err != nil {
+		return buildFlags{}, err
+	}
 	return buildFlags{
-		GitCommit: getGitCommit(version, replacements),
+		GitCommit: commit,
 		Version:   version,
-		GoVersion: getGoVersion(),
-		BuildDate: getBuildDate(),
-	}
+		GoVersion: w.goVer,
+		BuildDate: buildDate,
+	}, nil
 }
@@ -0,0 +1,212 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HookPoint is a point of the build where hooks
+// run: before or after one of its stages.
+type HookPoint string
+
+// PreStage returns the point before the stage, e.g. pre-get.
+func PreStage(s Stage) HookPoint { return HookPoint("pre-" + s) }
+
+// PostStage returns the point after the stage, e.g. post-compile.
+func PostStage(s Stage) HookPoint { return HookPoint("post-" + s) }
+
+// Stages are the stages of the build, in the order they run.
+var Stages = []Stage{StageInit, StageReplace, StageGet, StageTidy, StageVendor, StageCompile}
+
+// ParseHookPoint parses a hook point in the form pre-<stage> or post-<stage>.
+func ParseHookPoint(s string) (HookPoint, error) {
+	for _, stage := range Stages {
+		if p := PreStage(stage); s == string(p) {
+			return p, nil
+		}
+		if p := PostStage(stage); s == string(p) {
+			return p, nil
+		}
+	}
+	stages := make([]string, 0, len(Stages))
+	for _, stage := range Stages {
+		stages = append(stages, string(stage))
+	}
+	return "", fmt.Errorf("invalid hook point %q: expected pre-<stage> or post-<stage>, the stages being %s", s, strings.Join(stages, ", "))
+}
+
+// Hook is a step run at a point of the build, e.g. to patch the
+// go.mod after go get or to strip the binary after its compilation.
+type Hook struct {
+	Point HookPoint
+	// Command is a shell command, run with sh -c.
+	Command string
+	// Func, if set, is called instead of running a command.
+	Func func(ctx context.Context, env HookEnv) error
+}
+
+// ParseHook parses a hook in the form <point>=<command>.
+func ParseHook(s string) (Hook, error) {
+	point, command, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(command) == "" {
+		return Hook{}, fmt.Errorf("invalid hook %q: expected <point>=<command>", s)
+	}
+	p, err := ParseHookPoint(strings.TrimSpace(point))
+	if err != nil {
+		return Hook{}, err
+	}
+	return Hook{Point: p, Command: command}, nil
+}
+
+func (h Hook) String() string {
+	if h.Func != nil {
+		return string(h.Point) + "=<func>"
+	}
+	return string(h.Point) + "=" + h.Command
+}
+
+// HookEnv describes the build to a hook. Commands
+// get it in their environment, see Environ.
+type HookEnv struct {
+	Point HookPoint
+	// Workspace is the folder of the workspace, where the hooks run.
+	Workspace string
+	// Platform is the platform compiled by the compile hooks,
+	// the one of the builder for the others.
+	Platform Platform
+	// Target and Output are the target compiled and
+	// its binary, only set for the compile hooks.
+	Target string
+	Output string
+	// RevaVersion is the requested version of reva.
+	RevaVersion string
+}
+
+// Environ returns the environment variables describing the build:
+// GAIA_HOOK, GAIA_WORKSPACE, GAIA_OS, GAIA_ARCH, GAIA_REVA_VERSION,
+// and GAIA_TARGET and GAIA_OUTPUT for the compile hooks.
+func (e HookEnv) Environ() []string {
+	env := []string{
+		"GAIA_HOOK=" + string(e.Point),
+		"GAIA_WORKSPACE=" + e.Workspace,
+		"GAIA_OS=" + e.Platform.OS,
+		"GAIA_ARCH=" + e.Platform.Arch,
+		"GAIA_REVA_VERSION=" + e.RevaVersion,
+	}
+	if e.Output != "" {
+		env = append(env, "GAIA_TARGET="+e.Target, "GAIA_OUTPUT="+e.Output)
+	}
+	return env
+}
+
+// checkHooks fails on the hooks that would never run.
+func (b *Builder) checkHooks() error {
+	for _, h := range b.Hooks {
+		if _, err := ParseHookPoint(string(h.Point)); err != nil {
+			return err
+		}
+		if h.Func == nil && strings.TrimSpace(h.Command) == "" {
+			return fmt.Errorf("hook %s has no command", h.Point)
+		}
+	}
+	return nil
+}
+
+// hookStrings returns the hooks running at the points
+// selected by the filter, as strings, nil if there is none.
+func (b *Builder) hookStrings(filter func(HookPoint) bool) []string {
+	var hooks []string
+	for _, h := range b.Hooks {
+		if filter(h.Point) {
+			hooks = append(hooks, h.String())
+		}
+	}
+	return hooks
+}
+
+// isCompileHook returns true for the hooks of the compile stage.
+func isCompileHook(p HookPoint) bool {
+	return p == PreStage(StageCompile) || p == PostStage(StageCompile)
+}
+
+// runHooks runs the hooks of the point, in order,
+// stopping at the first one failing.
+func (b *Builder) runHooks(ctx context.Context, point HookPoint, e Event) error {
+	env := HookEnv{
+		Point:       point,
+		Workspace:   b.w.folder,
+		Platform:    b.Platform,
+		Target:      e.Target,
+		Output:      e.Output,
+		RevaVersion: b.RevaVersion,
+	}
+	if e.Platform != "" {
+		if p, err := ParsePlatform(e.Platform); err == nil {
+			env.Platform = p
+		}
+	}
+	for _, h := range b.Hooks {
+		if h.Point != point {
+			continue
+		}
+		b.Log.Info().Msgf("running hook %s", h)
+		var err error
+		if h.Func != nil {
+			err = h.Func(ctx, env)
+		} else {
+			err = b.w.runHookCommand(ctx, h.Command, env)
+		}
+		if err != nil {
+			return &HookError{Point: point, Hook: h.String(), Err: err}
+		}
+	}
+	return nil
+}
+
+// runHookCommand runs the command of a hook in the workspace, with
+// the environment of the go commands and the go of the build first
+// in the PATH, so that e.g. go generate runs as the build would.
+func (w workspace) runHookCommand(ctx context.Context, command string, env HookEnv) error {
+	var buf strings.Builder
+	out, flush := w.goCommandStderr(ctx, &buf)
+	args := []string{"-c", command}
+	cmd := w.newCommand(ctx, "sh", out, args...)
+	cmd.Stdout = out
+
+	path := fromEnv("PATH")
+	if filepath.IsAbs(w.gobin) {
+		path = filepath.Dir(w.gobin) + string(os.PathListSeparator) + path
+	}
+	cmd.Env = append(os.Environ(), w.goenv...)
+	cmd.Env = append(cmd.Env, "PATH="+path, "GOOS="+env.Platform.OS, "GOARCH="+env.Platform.Arch)
+	cmd.Env = append(cmd.Env, env.Environ()...)
+
+	w.log.Debug().Str("cmd", cmd.String()).Strs("env", cmd.Env).Send()
+	err := cmd.Run()
+	flush()
+	if err != nil {
+		return &CommandError{Args: append([]string{"sh"}, args...), Stderr: strings.TrimSpace(buf.String()), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// prepareStateFile records in the workspace
+// the inputs it was prepared with.
+const prepareStateFile = "gaia-prepare.json"
+
+// preparedFiles are the files Prepare writes in the workspace.
+var preparedFiles = []string{"go.mod", "go.sum", "main.go", "bflags", "vendor", targetsDir, prepareStateFile}
+
+// prepareInputs are all the inputs determining
+// the content of a prepared workspace.
+type prepareInputs struct {
+	GaiaVersion     string            `json:"gaia_version"`
+	GoVersion       string            `json:"go_version"`
+	RevaModule      string            `json:"reva_module"`
+	RevaVersion     string            `json:"reva_version"`
+	Plugins         []Plugin          `json:"plugins,omitempty"`
+	Resolved        []Plugin          `json:"resolved_plugins,omitempty"`
+	Replacement     []Replace         `json:"replacements,omitempty"`
+	LocalGoMods     map[string]string `json:"local_go_mods,omitempty"`
+	Lock            string            `json:"lock,omitempty"`
+	Template        string            `json:"template,omitempty"`
+	Targets         []Target          `json:"targets,omitempty"`
+	Tags            []string          `json:"tags,omitempty"`
+	LdFlags         string            `json:"ldflags,omitempty"`
+	Debug           bool              `json:"debug,omitempty"`
+	Static          bool              `json:"static,omitempty"`
+	StaticMusl      bool              `json:"static_musl,omitempty"`
+	Vendor          bool              `json:"vendor,omitempty"`
+	Offline         bool              `json:"offline,omitempty"`
+	Reproducible    bool              `json:"reproducible,omitempty"`
+	SourceDateEpoch string            `json:"source_date_epoch,omitempty"`
+	Hooks           []string          `json:"hooks,omitempty"`
+}
+
+func (in *prepareInputs) hash() string {
+	data, _ := json.Marshal(in)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// canUpdate returns true if a workspace prepared with the
+// inputs can be updated in place to the other ones.
+func (in *prepareInputs) canUpdate(other *prepareInputs) bool {
+	// the generated files and the go directive may differ
+	return in.GaiaVersion == other.GaiaVersion && in.GoVersion == other.GoVersion
+}
+
+// prepareState is the content of the prepare state file.
+type prepareState struct {
+	Hash   string        `json:"hash"`
+	Inputs prepareInputs `json:"inputs"`
+	// Applied are the replacements applied to the workspace,
+	// including the ones inherited from a local reva.
+	Applied []Replace `json:"applied_replacements,omitempty"`
+}
+
+// prepareInputs returns the inputs of the preparation of the workspace.
+// The go.mod of the local replacements is part of them, as it changes
+// the modules to resolve.
+func (b *Builder) prepareInputs() (*prepareInputs, error) {
+	in := &prepareInputs{
+		GaiaVersion:  gaiaVersion(),
+		GoVersion:    b.w.goVer,
+		RevaModule:   b.revaModule(),
+		RevaVersion:  b.RevaVersion,
+		Plugins:      b.Plugins,
+		Resolved:     resolvedPlugins(b.Plugins, b.resolved),
+		Replacement:  b.Replacement,
+		Targets:      b.Targets,
+		Tags:         b.Tags,
+		LdFlags:      b.LdFlags,
+		Debug:        b.Debug,
+		Static:       b.Static,
+		StaticMusl:   b.StaticMusl,
+		Vendor:       b.Vendor,
+		Offline:      b.Offline,
+		Reproducible: b.Reproducible,
+		// the compile hooks do not change the workspace
+		Hooks: b.hookStrings(func(p HookPoint) bool { return !isCompileHook(p) }),
+	}
+	var err error
+	if in.Template, err = b.templateDigest(); err != nil {
+		return nil, err
+	}
+	if b.Reproducible {
+		in.SourceDateEpoch = os.Getenv(SourceDateEpochEnv)
+	}
+	if b.Locked != nil {
+		data, err := json.Marshal(b.Locked)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		in.Lock = hex.EncodeToString(sum[:])
+	}
+	for _, r := range b.Replacement {
+		if r.ToVersion != "" {
+			continue
+		}
+		sum, err := FileSHA256(filepath.Join(r.To, "go.mod"))
+		if err != nil {
+			// not a local directory, or go mod edit reports it
+			continue
+		}
+		if in.LocalGoMods == nil {
+			in.LocalGoMods = make(map[string]string)
+		}
+		in.LocalGoMods[r.To] = sum
+	}
+	return in, nil
+}
+
+// readPrepareState returns the state of the workspace,
+// nil if it was not completely prepared by gaia.
+func (w *workspace) readPrepareState() (*prepareState, error) {
+	data, err := os.ReadFile(filepath.Join(w.folder, prepareStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s prepareState
+	if err := json.Unmarshal(data, &s); err != nil {
+		w.log.Warn().Err(err).Msgf("ignoring the invalid %s", prepareStateFile)
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (w *workspace) writePrepareState(s *prepareState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(w.folder, prepareStateFile), append(data, '\n'), 0644)
+}
+
+// removePrepared removes the files of a previous preparation,
+// leaving alone any other file in the workspace.
+func (w *workspace) removePrepared() error {
+	if _, err := os.Stat(filepath.Join(w.folder, "go.mod")); err == nil {
+		w.log.Info().Msgf("workspace %s cannot be updated: preparing it from scratch", w.folder)
+	}
+	for _, name := range preparedFiles {
+		if err := os.RemoveAll(filepath.Join(w.folder, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetRequirements readies the go.mod of a workspace prepared with other
+// inputs for the new ones: the replacements not applied anymore and all
+// the requirements but reva and the plugins are dropped, so that the
+// versions resolved by go mod tidy are the same as in a workspace prepared
+// from scratch, and not the ones raised by removed plugins.
+func (w *workspace) resetRequirements(ctx context.Context, plugins []Plugin, applied, replacement []Replace) error {
+	gomod, err := parseGoModFile(ctx, filepath.Join(w.folder, "go.mod"))
+	if err != nil {
+		return err
+	}
+
+	args := []string{"mod", "edit"}
+	for _, r := range applied {
+		if !slices.ContainsFunc(replacement, func(n Replace) bool { return n.From == r.From }) {
+			args = append(args, "-dropreplace="+r.From)
+		}
+	}
+	for _, r := range gomod.Require {
+		provides := func(p Plugin) bool {
+			return p.RepositoryPath == r.Path || strings.HasPrefix(p.RepositoryPath, r.Path+"/")
+		}
+		if r.Path != w.reva && !slices.ContainsFunc(plugins, provides) {
+			args = append(args, "-droprequire="+r.Path)
+		}
+	}
+	if len(args) == 2 {
+		return nil
+	}
+	w.log.Debug().Msgf("resetting the requirements: %s", strings.Join(args[2:], " "))
+	if err := w.runGoCommand(ctx, args...); err != nil {
+		return fmt.Errorf("error updating the workspace: %w", err)
+	}
+	return nil
+}
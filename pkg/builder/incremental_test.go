@@ -0,0 +1,188 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/zip"
+)
+
+// testModule is a module published on the test proxy.
+type testModule struct {
+	path, version string
+	require       []string
+	files         map[string]string
+}
+
+// writeTestProxy publishes the modules in a file proxy, downloads
+// them in a new module cache and makes it the one of the builds,
+// that must then be offline.
+func writeTestProxy(t *testing.T, mods []testModule) {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not found")
+	}
+
+	proxy := t.TempDir()
+	var download []string
+	for _, m := range mods {
+		gomod := "module " + m.path + "\n\ngo 1.21\n"
+		for _, r := range m.require {
+			gomod += "\nrequire " + strings.Replace(r, "@", " ", 1) + "\n"
+		}
+		src := t.TempDir()
+		files := map[string]string{"go.mod": gomod}
+		for name, data := range m.files {
+			files[name] = data
+		}
+		for name, data := range files {
+			if err := os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(src, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		escaped, err := module.EscapePath(m.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(proxy, escaped, "@v")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		info := `{"Version":"` + m.version + `","Time":"2024-01-01T00:00:00Z"}`
+		if err := os.WriteFile(filepath.Join(dir, m.version+".info"), []byte(info), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, m.version+".mod"), []byte(gomod), 0644); err != nil {
+			t.Fatal(err)
+		}
+		z, err := os.Create(filepath.Join(dir, m.version+".zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := zip.CreateFromDir(z, module.Version{Path: m.path, Version: m.version}, src); err != nil {
+			t.Fatal(err)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		list, err := os.OpenFile(filepath.Join(dir, "list"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := list.WriteString(m.version + "\n"); err != nil {
+			t.Fatal(err)
+		}
+		if err := list.Close(); err != nil {
+			t.Fatal(err)
+		}
+		download = append(download, m.path+"@"+m.version)
+	}
+
+	modcache := t.TempDir()
+	env := append(os.Environ(), "GOPROXY=file://"+filepath.ToSlash(proxy), "GOSUMDB=off", "GOFLAGS=", "GOMODCACHE="+modcache)
+	cmd := exec.Command("go", append([]string{"mod", "download"}, download...)...)
+	cmd.Dir = proxy
+	cmd.Env = env
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("error populating the module cache: %v\n%s", err, out)
+	}
+	// the module cache is read-only
+	t.Cleanup(func() {
+		cmd := exec.Command("go", "clean", "-modcache")
+		cmd.Env = env
+		_ = cmd.Run()
+	})
+
+	t.Setenv("GOMODCACHE", modcache)
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOFLAGS", "")
+}
+
+// requirements returns the requirements in the go.mod of the workspace.
+func requirements(t *testing.T, folder string) []string {
+	t.Helper()
+	gomod, err := parseGoModFile(context.Background(), filepath.Join(folder, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reqs []string
+	for _, r := range gomod.Require {
+		reqs = append(reqs, r.Path+"@"+r.Version)
+	}
+	slices.Sort(reqs)
+	return reqs
+}
+
+func TestPrepareWithFewerPlugins(t *testing.T) {
+	revad := map[string]string{"cmd/revad/revad.go": "package revad\n\nfunc Main() {}\n"}
+	lib := map[string]string{"lib.go": "package lib\n"}
+	plugin := map[string]string{"plugin.go": "package plugin\n\nimport _ \"example.org/lib\"\n"}
+	writeTestProxy(t, []testModule{
+		{path: "example.org/reva", version: "v1.0.0", files: revad},
+		{path: "example.org/reva", version: "v1.1.0", files: revad},
+		{path: "example.org/lib", version: "v1.0.0", files: lib},
+		{path: "example.org/lib", version: "v1.1.0", files: lib},
+		{path: "example.org/a", version: "v1.0.0", require: []string{"example.org/reva@v1.0.0", "example.org/lib@v1.1.0"}, files: plugin},
+		{path: "example.org/b", version: "v1.0.0", require: []string{"example.org/reva@v1.0.0", "example.org/lib@v1.0.0"}, files: plugin},
+	})
+
+	prepare := func(folder string, plugins ...Plugin) {
+		t.Helper()
+		b := &Builder{
+			RevaModule:     "example.org/reva",
+			RevaVersion:    "v1.0.0",
+			Plugins:        plugins,
+			Offline:        true,
+			TempFolder:     folder,
+			LeaveWorkspace: true,
+		}
+		if err := b.Prepare(context.Background()); err != nil {
+			t.Fatalf("error preparing %v: %v", plugins, err)
+		}
+	}
+	a := Plugin{RepositoryPath: "example.org/a", Version: "v1.0.0"}
+	b := Plugin{RepositoryPath: "example.org/b", Version: "v1.0.0"}
+
+	updated := t.TempDir()
+	prepare(updated, a, b)
+	if reqs := requirements(t, updated); !slices.Contains(reqs, "example.org/lib@v1.1.0") {
+		t.Fatalf("plugin a did not raise lib: %v", reqs)
+	}
+	prepare(updated, b)
+
+	fresh := t.TempDir()
+	prepare(fresh, b)
+
+	got, want := requirements(t, updated), requirements(t, fresh)
+	if !slices.Equal(got, want) {
+		t.Errorf("requirements of the updated workspace = %v, want %v as when prepared from scratch", got, want)
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/mod/module"
+)
+
+// ErrNotRevad is returned when inspecting a binary
+// that is not a revad built by gaia.
+var ErrNotRevad = errors.New("not a revad binary")
+
+// markers of the build description embedded in the binary
+const (
+	buildInfoBegin = "gaia-build-info-begin:"
+	buildInfoEnd   = ":gaia-build-info-end"
+)
+
+// BinaryInfo describes how a revad binary was built.
+// Since gaia embeds it in the binaries it builds, its
+// JSON encoding must stay backward compatible.
+type BinaryInfo struct {
+	GaiaVersion  string    `json:"gaia_version,omitempty"`
+	RevaModule   string    `json:"reva_module,omitempty"`
+	RevaVersion  string    `json:"reva_version"`
+	RevaReplace  *Replace  `json:"reva_replace,omitempty"`
+	GitCommit    string    `json:"git_commit,omitempty"`
+	GoVersion    string    `json:"go_version"`
+	BuildDate    string    `json:"build_date,omitempty"`
+	Platform     Platform  `json:"platform,omitzero"`
+	Plugins      []Plugin  `json:"plugins,omitempty"`
+	Replacement  []Replace `json:"replacements,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	LdFlags      string    `json:"ldflags,omitempty"`
+	Debug        bool      `json:"debug,omitempty"`
+	Static       bool      `json:"static,omitempty"`
+	StaticMusl   bool      `json:"static_musl,omitempty"`
+	Vendor       bool      `json:"vendor,omitempty"`
+	Reproducible bool      `json:"reproducible,omitempty"`
+	Template     string    `json:"template,omitempty"`
+	// Target is the reva command built, nil for revad.
+	Target *Target `json:"target,omitempty"`
+	// Embedded tells that the information comes from the
+	// description embedded by gaia, and is thus exact.
+	Embedded bool `json:"-"`
+	// Warnings lists what could not be determined exactly.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// readEmbeddedInfo returns the build description embedded
+// in the binary, or nil if the binary does not have one.
+func readEmbeddedInfo(path string) (*BinaryInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	begin := bytes.Index(data, []byte(buildInfoBegin))
+	if begin < 0 {
+		return nil, nil
+	}
+	data = data[begin+len(buildInfoBegin):]
+	end := bytes.Index(data, []byte(buildInfoEnd))
+	if end < 0 {
+		return nil, nil
+	}
+	var info BinaryInfo
+	if err := json.Unmarshal(data[:end], &info); err != nil {
+		return nil, fmt.Errorf("error decoding the build description of %s: %w", path, err)
+	}
+	info.Embedded = true
+	return &info, nil
+}
+
+// Inspect reads the build information embedded in a revad binary.
+// Binaries built by gaia carry an exact description of the build,
+// see Builder.Prepare. For older ones, the description is rebuilt
+// from the go build info: the variables injected with -X are only recorded by the go toolchain
+// for builds without -trimpath, that is debug builds: otherwise the
+// version and the commit are derived from the reva module, and the
+// build date is unknown.
+// The plugins are the modules linked in the binary that are not required
+// by reva nor by another of those modules: finding them needs the go.mod
+// of reva and of the plugins, that are taken from the module cache or,
+// unless offline, downloaded.
+func Inspect(ctx context.Context, path string, offline bool, log *zerolog.Logger) (*BinaryInfo, error) {
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading build info of %s: %w", path, err)
+	}
+
+	for _, m := range bi.Deps {
+		// local replacements are reported as development versions
+		if m.Replace != nil && m.Replace.Version == "(devel)" {
+			m.Replace.Version = ""
+		}
+	}
+
+	// binaries built by recent versions of gaia describe themselves
+	embedded, err := readEmbeddedInfo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// reva is the module embedded, or any major version of cs3org reva
+	var revaModule string
+	if embedded != nil {
+		revaModule = embedded.RevaModule
+	}
+	var reva *debug.Module
+	for _, m := range bi.Deps {
+		if m.Path == revaModule || revaModule == "" && isRevaModule(m.Path) {
+			reva = m
+			break
+		}
+	}
+	if reva == nil {
+		return nil, fmt.Errorf("%w: %s does not contain reva", ErrNotRevad, path)
+	}
+
+	info := &BinaryInfo{
+		RevaModule:  reva.Path,
+		RevaVersion: reva.Version,
+		GoVersion:   strings.TrimPrefix(bi.GoVersion, "go"),
+	}
+	if reva.Replace != nil {
+		info.RevaReplace = &Replace{From: reva.Path, To: reva.Replace.Path, ToVersion: reva.Replace.Version}
+	}
+
+	settings := make(map[string]string, len(bi.Settings))
+	for _, s := range bi.Settings {
+		settings[s.Key] = s.Value
+	}
+	platform := Platform{OS: settings["GOOS"], Arch: settings["GOARCH"]}
+
+	if embedded != nil {
+		embedded.RevaModule = reva.Path
+		embedded.Platform = platform
+		return embedded, nil
+	}
+
+	info.Platform = platform
+	if tags := settings["-tags"]; tags != "" {
+		info.Tags = strings.Split(tags, ",")
+	}
+	info.Debug = strings.Contains(settings["-gcflags"], "-N -l")
+
+	if ldflags, ok := settings["-ldflags"]; ok {
+		info.parseLdFlags(ldflags)
+	} else {
+		if module.IsPseudoVersion(reva.Version) {
+			if rev, err := module.PseudoVersionRev(reva.Version); err == nil {
+				info.GitCommit = shortCommit(rev)
+			}
+		}
+		info.Warnings = append(info.Warnings, "the binary was built with -trimpath: the build date, the commit and the ldflags are not recorded")
+	}
+
+	if log == nil {
+		l := zerolog.Nop()
+		log = &l
+	}
+	b := &Builder{RevaModule: reva.Path, Offline: offline, Log: log}
+	if err := b.getWorkspace(); err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	plugins, unknown, err := b.w.findPlugins(ctx, reva, bi.Deps)
+	if err != nil {
+		info.Warnings = append(info.Warnings, "unable to tell the plugins apart from their dependencies: "+err.Error())
+	}
+	if len(unknown) != 0 {
+		info.Warnings = append(info.Warnings, "the requirements of "+strings.Join(unknown, ", ")+" are not available: they might be dependencies rather than plugins")
+	}
+	for _, m := range bi.Deps {
+		if m.Replace == nil || m.Path == reva.Path {
+			continue
+		}
+		r := Replace{From: m.Path, To: m.Replace.Path, ToVersion: m.Replace.Version}
+		info.Replacement = append(info.Replacement, r)
+	}
+	for _, m := range plugins {
+		info.Plugins = append(info.Plugins, Plugin{RepositoryPath: m.Path, Version: m.Version})
+	}
+
+	return info, nil
+}
+
+// parseLdFlags extracts the variables set by gaia
+// and the linking options from the ldflags.
+func (info *BinaryInfo) parseLdFlags(ldflags string) {
+	var custom []string
+	fields := strings.Fields(ldflags)
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		switch {
+		case f == "-X" && i+1 < len(fields):
+			i++
+			key, val, _ := strings.Cut(fields[i], "=")
+			// the variables may be in the package of any target
+			dot := strings.LastIndexByte(key, '.')
+			if dot == -1 || !strings.HasPrefix(key, info.RevaModule+"/") {
+				custom = append(custom, "-X", fields[i])
+				continue
+			}
+			switch key[dot+1:] {
+			case "gitCommit":
+				info.GitCommit = val
+			case "buildDate":
+				info.BuildDate = val
+			case "version", "goVersion":
+				// already known from the build info
+			default:
+				custom = append(custom, "-X", fields[i])
+			}
+		case f == "-extldflags=-static":
+			info.Static = true
+		case f == "-extldflags" && i+1 < len(fields) && fields[i+1] == "'-static'":
+			i++
+			info.StaticMusl = true
+		default:
+			custom = append(custom, f)
+		}
+	}
+	info.LdFlags = strings.Join(custom, " ")
+	if info.StaticMusl {
+		info.Tags = slices.DeleteFunc(info.Tags, func(t string) bool { return t == "sqlite_omit_load_extension" })
+	}
+}
+
+// findPlugins returns the modules linked in the binary that are required
+// neither by reva nor by any other module not required by reva, and the
+// modules whose requirements could not be read.
+func (w *workspace) findPlugins(ctx context.Context, reva *debug.Module, deps []*debug.Module) ([]*debug.Module, []string, error) {
+	revaRequire, err := w.moduleRequirements(ctx, reva)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading the requirements of reva: %w", err)
+	}
+
+	var candidates []*debug.Module
+	for _, m := range deps {
+		if m.Path != reva.Path && !slices.Contains(revaRequire, m.Path) {
+			candidates = append(candidates, m)
+		}
+	}
+
+	required := make(map[string]bool)
+	var unknown []string
+	for _, m := range candidates {
+		reqs, err := w.moduleRequirements(ctx, m)
+		if err != nil {
+			// the module is kept, even if it might be only a dependency
+			w.log.Debug().Err(err).Msgf("unable to read the requirements of %s", m.Path)
+			unknown = append(unknown, m.Path)
+			continue
+		}
+		for _, r := range reqs {
+			required[r] = true
+		}
+	}
+
+	return slices.DeleteFunc(candidates, func(m *debug.Module) bool { return required[m.Path] }), unknown, nil
+}
+
+// moduleRequirements returns the paths of the modules required
+// in the go.mod of the given module, taking the replacement into account.
+func (w *workspace) moduleRequirements(ctx context.Context, m *debug.Module) ([]string, error) {
+	path, version := m.Path, m.Version
+	var gomod string
+	if m.Replace != nil {
+		if m.Replace.Version == "" {
+			// replaced with a local directory, that may
+			// not exist on this machine
+			gomod = filepath.Join(m.Replace.Path, "go.mod")
+			if _, err := os.Stat(gomod); err != nil {
+				return nil, err
+			}
+		}
+		path, version = m.Replace.Path, m.Replace.Version
+	}
+	if gomod == "" {
+		d, err := w.downloadModule(ctx, path, version)
+		if err != nil {
+			return nil, err
+		}
+		gomod = d.GoMod
+	}
+
+	parsed, err := parseGoModFile(ctx, gomod)
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]string, 0, len(parsed.Require))
+	for _, r := range parsed.Require {
+		reqs = append(reqs, r.Path)
+	}
+	return reqs, nil
+}
+
+// Recipe returns the recipe rebuilding the binary.
+func (info *BinaryInfo) Recipe() *Recipe {
+	r := &Recipe{
+		RevaVersion:  info.RevaVersion,
+		Tags:         info.Tags,
+		LdFlags:      info.LdFlags,
+		Debug:        info.Debug,
+		Static:       info.Static,
+		StaticMusl:   info.StaticMusl,
+		Vendor:       info.Vendor,
+		Reproducible: info.Reproducible,
+		Template:     info.Template,
+	}
+	// the same binary is only built again by the same toolchain
+	if info.Reproducible {
+		r.GoVersion = info.GoVersion
+	}
+	if info.RevaModule != "" && info.RevaModule != RevaModuleForVersion(info.RevaVersion) {
+		r.RevaModule = info.RevaModule
+	}
+	if info.Target != nil {
+		r.Targets = []string{info.Target.String()}
+	}
+	if info.RevaReplace != nil {
+		r.With = append(r.With, info.RevaReplace.From+"@"+info.RevaVersion+"="+replaceTarget(*info.RevaReplace))
+	}
+	for _, p := range info.Plugins {
+		with := p.String()
+		for _, repl := range info.Replacement {
+			if repl.From == p.RepositoryPath {
+				with += "=" + replaceTarget(repl)
+			}
+		}
+		r.With = append(r.With, with)
+	}
+	if info.Platform.OS != "" && info.Platform.Arch != "" {
+		r.Platforms = []string{info.Platform.String()}
+	}
+	return r
+}
+
+func replaceTarget(r Replace) string {
+	if r.ToVersion == "" {
+		return r.To
+	}
+	return r.To + "@" + r.ToVersion
+}
+
+// Command returns the gaia build command line rebuilding the binary.
+func (info *BinaryInfo) Command() string {
+	r := info.Recipe()
+	args := []string{"gaia", "build"}
+	if r.RevaVersion != "" {
+		args = append(args, r.RevaVersion)
+	}
+	if r.RevaModule != "" {
+		args = append(args, "--reva-module", r.RevaModule)
+	}
+	if len(r.With) != 0 {
+		args = append(args, "--with", shellQuote(strings.Join(r.With, ",")))
+	}
+	if len(r.Tags) != 0 {
+		args = append(args, "--tags", shellQuote(strings.Join(r.Tags, ",")))
+	}
+	if r.LdFlags != "" {
+		args = append(args, "--ldflags", shellQuote(r.LdFlags))
+	}
+	if r.Debug {
+		args = append(args, "--debug")
+	}
+	if r.Static {
+		args = append(args, "--static")
+	}
+	if r.StaticMusl {
+		args = append(args, "--static-musl")
+	}
+	if r.Vendor {
+		args = append(args, "--vendor")
+	}
+	if r.Reproducible {
+		args = append(args, "--reproducible")
+	}
+	if r.GoVersion != "" {
+		args = append(args, "--go-version", r.GoVersion)
+	}
+	if r.Template != "" {
+		args = append(args, "--template", shellQuote(r.Template))
+	}
+	if len(r.Targets) != 0 {
+		args = append(args, "--target", shellQuote(strings.Join(r.Targets, ",")), "-o", "./"+info.Target.Name)
+	}
+	if len(r.Platforms) != 0 {
+		args = append(args, "--platform", r.Platforms[0])
+	}
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`*?[]{}()<>|&;#~") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
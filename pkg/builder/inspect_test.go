@@ -0,0 +1,115 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLdFlags(t *testing.T) {
+	const revaModule = "github.com/cs3org/reva/v3"
+	gaiaFlags := buildFlags{
+		GitCommit: "0123abc",
+		Version:   "v3.0.1",
+		GoVersion: "go1.22.5",
+		BuildDate: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}.Format(revaModule+"/cmd/revad", revaModule+"/cmd/reva")
+
+	tests := []struct {
+		name       string
+		ldflags    string
+		tags       []string
+		want       BinaryInfo
+		wantInArgs []string
+	}{
+		{
+			name:    "variables set by gaia",
+			ldflags: gaiaFlags,
+			want:    BinaryInfo{GitCommit: "0123abc", BuildDate: "2024-01-02T03:04:05Z"},
+		},
+		{
+			name:       "custom flags",
+			ldflags:    gaiaFlags + " -s -w -X main.edition=ce",
+			want:       BinaryInfo{GitCommit: "0123abc", BuildDate: "2024-01-02T03:04:05Z", LdFlags: "-s -w -X main.edition=ce"},
+			wantInArgs: []string{"--ldflags '-s -w -X main.edition=ce'"},
+		},
+		{
+			name:       "other variable of reva",
+			ldflags:    "-X " + revaModule + "/cmd/revad.edition=ce",
+			want:       BinaryInfo{LdFlags: "-X " + revaModule + "/cmd/revad.edition=ce"},
+			wantInArgs: []string{"--ldflags '-X " + revaModule + "/cmd/revad.edition=ce'"},
+		},
+		{
+			name:       "static",
+			ldflags:    gaiaFlags + " -extldflags=-static",
+			want:       BinaryInfo{GitCommit: "0123abc", BuildDate: "2024-01-02T03:04:05Z", Static: true},
+			wantInArgs: []string{"--static"},
+		},
+		{
+			name:       "static with musl",
+			ldflags:    gaiaFlags + " -extldflags '-static'",
+			tags:       []string{"netgo", "sqlite_omit_load_extension"},
+			want:       BinaryInfo{GitCommit: "0123abc", BuildDate: "2024-01-02T03:04:05Z", StaticMusl: true, Tags: []string{"netgo"}},
+			wantInArgs: []string{"--static-musl", "--tags netgo"},
+		},
+		{
+			name:    "no ldflags",
+			ldflags: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &BinaryInfo{RevaModule: revaModule, RevaVersion: "v3.0.1", Tags: slices.Clone(tt.tags)}
+			info.parseLdFlags(tt.ldflags)
+			if info.GitCommit != tt.want.GitCommit || info.BuildDate != tt.want.BuildDate {
+				t.Errorf("commit, date = %q, %q, want %q, %q", info.GitCommit, info.BuildDate, tt.want.GitCommit, tt.want.BuildDate)
+			}
+			if info.LdFlags != tt.want.LdFlags {
+				t.Errorf("LdFlags = %q, want %q", info.LdFlags, tt.want.LdFlags)
+			}
+			if info.Static != tt.want.Static || info.StaticMusl != tt.want.StaticMusl {
+				t.Errorf("Static, StaticMusl = %t, %t, want %t, %t", info.Static, info.StaticMusl, tt.want.Static, tt.want.StaticMusl)
+			}
+			if !slices.Equal(info.Tags, tt.want.Tags) {
+				t.Errorf("Tags = %v, want %v", info.Tags, tt.want.Tags)
+			}
+
+			cmd := info.Command()
+			if !strings.HasPrefix(cmd, "gaia build v3.0.1") {
+				t.Errorf("Command() = %q, want it to build v3.0.1", cmd)
+			}
+			for _, arg := range tt.wantInArgs {
+				if !strings.Contains(cmd, arg) {
+					t.Errorf("Command() = %q, want it to contain %q", cmd, arg)
+				}
+			}
+			// the variables set by gaia are set again by the build
+			if strings.Contains(cmd, "gitCommit") || strings.Contains(cmd, "buildDate") {
+				t.Errorf("Command() = %q, want it without the variables set by gaia", cmd)
+			}
+			args := strings.Fields(cmd)
+			if slices.Contains(args, "--static") != tt.want.Static || slices.Contains(args, "--static-musl") != tt.want.StaticMusl {
+				t.Errorf("Command() = %q, want static = %t and static musl = %t", cmd, tt.want.Static, tt.want.StaticMusl)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// LockFileName is the default name of the lock file.
+const LockFileName = "gaia.lock"
+
+// ErrLockDrift is returned when a locked build does not resolve
+// the same modules recorded in the lock file.
+var ErrLockDrift = errors.New("resolved modules differ from the lock file")
+
+// Lock records the exact modules resolved when preparing a build,
+// so that the same dependency set can be reproduced later.
+type Lock struct {
+	Reva    LockedModule   `json:"reva"`
+	Plugins []LockedModule `json:"plugins,omitempty"`
+	Modules []LockedModule `json:"modules"`
+}
+
+// LockedModule is a module resolved in a build.
+type LockedModule struct {
+	Path     string `json:"path"`
+	Version  string `json:"version"`
+	Replace  string `json:"replace,omitempty"`
+	Sum      string `json:"sum,omitempty"`
+	GoModSum string `json:"go_mod_sum,omitempty"`
+	// Requested is the range, or compatible, a plugin was
+	// requested with, that Version was chosen for.
+	Requested string `json:"requested,omitempty"`
+}
+
+func (m LockedModule) String() string {
+	s := m.Path + "@" + m.Version
+	if m.Replace != "" {
+		s += " => " + m.Replace
+	}
+	return s
+}
+
+// sumKey returns the path and version used for the module in go.sum,
+// that is the one of the replacement, if the module has been
+// replaced by another module.
+func (m LockedModule) sumKey() (string, string) {
+	if m.Replace == "" {
+		return m.Path, m.Version
+	}
+	path, version, ok := strings.Cut(m.Replace, "@")
+	if !ok {
+		// replaced with a local directory: there is no checksum
+		return "", ""
+	}
+	return path, version
+}
+
+// ReadLock reads the lock stored in the given file.
+func ReadLock(path string) (*Lock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var l Lock
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("error decoding lock file %s: %w", path, err)
+	}
+	return &l, nil
+}
+
+// WriteFile stores the lock in the given file.
+func (l *Lock) WriteFile(path string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// the version ranges are kept readable
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(l); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// module returns the locked module providing the given package.
+func (l *Lock) module(pkg string) (LockedModule, bool) {
+	return findModule(l.Modules, pkg)
+}
+
+// findModule returns the module whose path is the longest
+// prefix of the given package path.
+func findModule(modules []LockedModule, pkg string) (LockedModule, bool) {
+	var found LockedModule
+	var ok bool
+	for _, m := range modules {
+		if pkg != m.Path && !strings.HasPrefix(pkg, m.Path+"/") {
+			continue
+		}
+		if !ok || len(m.Path) > len(found.Path) {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+// Lock returns the modules resolved in the prepared workspace.
+func (b *Builder) Lock(ctx context.Context) (*Lock, error) {
+	if b.w == nil {
+		if err := b.getWorkspace(); err != nil {
+			return nil, err
+		}
+	}
+
+	modules, err := b.w.listModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := readGoSum(filepath.Join(b.w.folder, "go.sum"))
+	if err != nil {
+		return nil, err
+	}
+
+	var l Lock
+	for _, m := range modules {
+		lm := LockedModule{
+			Path:    m.Path,
+			Version: m.Version,
+		}
+		if m.Replace != nil {
+			lm.Replace = m.Replace.Path
+			if m.Replace.Version != "" {
+				lm.Replace += "@" + m.Replace.Version
+			}
+		}
+		if path, version := lm.sumKey(); path != "" {
+			lm.Sum = sums[path+" "+version]
+			lm.GoModSum = sums[path+" "+version+"/go.mod"]
+		}
+		l.Modules = append(l.Modules, lm)
+	}
+
+	reva, ok := l.module(b.w.reva)
+	if !ok {
+		return nil, fmt.Errorf("module %s not found in the workspace", b.w.reva)
+	}
+	l.Reva = reva
+	for _, p := range b.Plugins {
+		if p.RepositoryPath == b.w.reva {
+			continue
+		}
+		m, ok := l.module(p.RepositoryPath)
+		if !ok {
+			return nil, fmt.Errorf("module for plugin %s not found in the workspace", p.RepositoryPath)
+		}
+		if IsVersionRange(p.Version) {
+			m.Requested = p.Version
+		}
+		if !slices.Contains(l.Plugins, m) {
+			l.Plugins = append(l.Plugins, m)
+		}
+	}
+	return &l, nil
+}
+
+// readGoSum parses a go.sum file into a map from
+// "path version" to the corresponding hash.
+func readGoSum(path string) (map[string]string, error) {
+	sums := make(map[string]string)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sums, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	return sums, s.Err()
+}
+
+// checkLockedVersion returns an error if an exact version, or a range,
+// was requested for a module and the one in the lock does not match it.
+// Version queries (latest, branches, compatible, ...) always resolve
+// to the locked version.
+func checkLockedVersion(m LockedModule, requested string) error {
+	if IsVersionRange(requested) && requested != CompatibleVersion {
+		r, err := ParseVersionRange(requested)
+		if err != nil {
+			return err
+		}
+		if !r.Match(m.Version) {
+			return fmt.Errorf("%w: %s requested at %s but locked at %s", ErrLockDrift, m.Path, requested, m.Version)
+		}
+		return nil
+	}
+	if requested == "" || !semver.IsValid(requested) || requested == m.Version {
+		return nil
+	}
+	return fmt.Errorf("%w: %s requested at %s but locked at %s", ErrLockDrift, m.Path, requested, m.Version)
+}
+
+// applyLock requires in the workspace all the modules at the versions
+// recorded in the lock, seeding go.sum with the locked checksums, so
+// that any module whose content changed fails the verification.
+func (b *Builder) applyLock(ctx context.Context, l *Lock) error {
+	if err := checkLockedVersion(l.Reva, b.RevaVersion); err != nil {
+		return err
+	}
+	for _, p := range b.Plugins {
+		m, ok := l.module(p.RepositoryPath)
+		if !ok {
+			return fmt.Errorf("%w: plugin %s is not in the lock file", ErrLockDrift, p.RepositoryPath)
+		}
+		if err := checkLockedVersion(m, p.Version); err != nil {
+			return err
+		}
+	}
+
+	f, err := b.w.CreateFile("go.sum")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, m := range l.Modules {
+		path, version := m.sumKey()
+		if m.Sum != "" {
+			fmt.Fprintf(f, "%s %s %s\n", path, version, m.Sum)
+		}
+		if m.GoModSum != "" {
+			fmt.Fprintf(f, "%s %s/go.mod %s\n", path, version, m.GoModSum)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	args := []string{"mod", "edit"}
+	for _, m := range l.Modules {
+		args = append(args, "-require="+m.Path+"@"+m.Version)
+	}
+	return b.w.runGoCommand(ctx, args...)
+}
+
+// verifyLock checks that the modules resolved in the
+// workspace are exactly the ones recorded in the lock.
+func (b *Builder) verifyLock(ctx context.Context, l *Lock) error {
+	current, err := b.Lock(ctx)
+	if err != nil {
+		return err
+	}
+
+	locked := make(map[string]LockedModule, len(l.Modules))
+	for _, m := range l.Modules {
+		locked[m.Path] = m
+	}
+
+	var diffs []string
+	for _, m := range current.Modules {
+		lm, ok := locked[m.Path]
+		delete(locked, m.Path)
+		switch {
+		case !ok:
+			diffs = append(diffs, "unexpected module "+m.String())
+		case lm.Version != m.Version || lm.Replace != m.Replace:
+			diffs = append(diffs, fmt.Sprintf("%s resolved as %s", lm, m))
+		case lm.Sum != "" && m.Sum != "" && lm.Sum != m.Sum:
+			diffs = append(diffs, fmt.Sprintf("checksum of %s changed from %s to %s", m, lm.Sum, m.Sum))
+		}
+	}
+	for _, m := range l.Modules {
+		if _, ok := locked[m.Path]; ok {
+			diffs = append(diffs, "missing module "+m.String())
+		}
+	}
+
+	if len(diffs) != 0 {
+		return fmt.Errorf("%w:\n\t%s", ErrLockDrift, strings.Join(diffs, "\n\t"))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckLockedVersion(t *testing.T) {
+	locked := LockedModule{Path: "example.org/plugin", Version: "v1.2.5"}
+	tests := []struct {
+		requested string
+		drift     bool
+	}{
+		{"", false},
+		{"v1.2.5", false},
+		{"v1.2.4", true},
+		{"latest", false},
+		{"main", false},
+		{CompatibleVersion, false},
+		{"<v1.3.0", false},
+		{"^1.2", false},
+		{"~1.2.0", false},
+		{"v1.2", false},
+		{">=1.0 <2", false},
+		{"^1.3", true},
+		{"~1.1.0", true},
+		{"v1.3", true},
+		{"=1.2.4", true},
+	}
+	for _, tt := range tests {
+		err := checkLockedVersion(locked, tt.requested)
+		if drift := errors.Is(err, ErrLockDrift); drift != tt.drift {
+			t.Errorf("checkLockedVersion(%s, %q) = %v, want drift %v", locked.Version, tt.requested, err, tt.drift)
+		}
+	}
+}
+
+func TestCheckLockedVersionInvalidRange(t *testing.T) {
+	err := checkLockedVersion(LockedModule{Path: "example.org/plugin", Version: "v1.2.5"}, "^1.x")
+	if err == nil || errors.Is(err, ErrLockDrift) {
+		t.Errorf("checkLockedVersion with an invalid range = %v, want a parse error", err)
+	}
+}
@@ -0,0 +1,779 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	ociMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	dockerMediaTypeList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	ociAnnotationRefName = "org.opencontainers.image.ref.name"
+	ociAnnotationCreated = "org.opencontainers.image.created"
+	gaiaLabelBuildInfo   = "org.cs3.gaia.build-info"
+	gaiaLabelTargets     = "org.cs3.gaia.targets"
+
+	// ociBinDir is where the binaries are put in the image.
+	ociBinDir     = "usr/local/bin"
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+)
+
+// OCIOptions configures the OCI image built with WriteOCI.
+type OCIOptions struct {
+	// Base is the path of a local OCI image layout, a directory or a
+	// tar, optionally followed by :<ref> to select one of its images.
+	// The image is built from scratch when empty or "scratch".
+	Base string
+	// Entrypoint overrides the entrypoint of the image,
+	// by default the first binary.
+	Entrypoint []string
+	// Labels are added to the ones describing the build.
+	Labels map[string]string
+	// Ref names the image in the layout, the
+	// version of reva by default.
+	Ref string
+}
+
+// OCIError is returned when the OCI image cannot be written,
+// or the base image cannot be read.
+type OCIError struct {
+	Path string
+	Err  error
+}
+
+func (e *OCIError) Error() string {
+	return "error with the OCI image " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *OCIError) Unwrap() error { return e.Err }
+
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociImageConfig is the configuration of an image. The fields of
+// the base image gaia does not change are kept as they are.
+type ociImageConfig struct {
+	Created      string       `json:"created,omitempty"`
+	Author       string       `json:"author,omitempty"`
+	Architecture string       `json:"architecture"`
+	OS           string       `json:"os"`
+	Variant      string       `json:"variant,omitempty"`
+	Config       ociRunConfig `json:"config"`
+	RootFS       ociRootFS    `json:"rootfs"`
+	History      []ociHistory `json:"history,omitempty"`
+}
+
+type ociRunConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociHistory struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// ociBinary is a binary put in the image.
+type ociBinary struct {
+	Path string
+	Name string
+	Info *BinaryInfo
+	// GoArm is the GOARM the binary was built with, for arm.
+	GoArm string
+}
+
+// WriteOCI writes an OCI image layout with the binaries, in the
+// directory dest or, if it ends with .tar, in a tar archive.
+// The binaries are grouped by platform, read from their build
+// information: each platform gets an image, with the binaries
+// in /usr/local/bin on top of the base image, and the images
+// are listed in a multi-platform index. The labels of the images
+// describe the build, the creation date is the build date.
+func WriteOCI(ctx context.Context, dest string, binaries []string, opts OCIOptions, log *zerolog.Logger) error {
+	if len(binaries) == 0 {
+		return &OCIError{Path: dest, Err: errors.New("no binary to put in the image")}
+	}
+
+	var platforms []Platform
+	byPlatform := make(map[Platform][]ociBinary)
+	for _, p := range binaries {
+		info, err := Inspect(ctx, p, true, log)
+		if err != nil {
+			return &OCIError{Path: dest, Err: err}
+		}
+		name := DefaultTarget.Name
+		if info.Target != nil {
+			name = info.Target.Name
+		}
+		if !slices.Contains(platforms, info.Platform) {
+			platforms = append(platforms, info.Platform)
+		}
+		if slices.ContainsFunc(byPlatform[info.Platform], func(b ociBinary) bool { return b.Name == name }) {
+			return &OCIError{Path: dest, Err: fmt.Errorf("%s given twice for %s", name, info.Platform)}
+		}
+		b := ociBinary{Path: p, Name: name, Info: info}
+		if info.Platform.Arch == "arm" {
+			b.GoArm = goArm(p)
+		}
+		byPlatform[info.Platform] = append(byPlatform[info.Platform], b)
+	}
+
+	var base *ociLayout
+	if opts.Base != "" && opts.Base != "scratch" {
+		var err error
+		if base, err = openOCILayout(opts.Base); err != nil {
+			return &OCIError{Path: opts.Base, Err: err}
+		}
+		defer base.Close()
+	}
+
+	// the layout is written next to its destination, and moved in place when complete
+	staging, err := os.MkdirTemp(filepath.Dir(dest), ".gaia-oci-*")
+	if err != nil {
+		return &OCIError{Path: dest, Err: err}
+	}
+	defer os.RemoveAll(staging)
+	w := &ociLayout{dir: staging}
+
+	ref := opts.Ref
+	if ref == "" {
+		ref = byPlatform[platforms[0]][0].Info.RevaVersion
+	}
+	if ref == "" {
+		ref = "latest"
+	}
+
+	index := ociIndex{SchemaVersion: 2, MediaType: ociMediaTypeIndex}
+	for _, p := range platforms {
+		d, err := w.writeImage(base, p, byPlatform[p], opts)
+		if err != nil {
+			return &OCIError{Path: dest, Err: err}
+		}
+		index.Manifests = append(index.Manifests, d)
+	}
+	indexDesc, err := w.writeJSONBlob(ociMediaTypeIndex, index)
+	if err != nil {
+		return &OCIError{Path: dest, Err: err}
+	}
+	indexDesc.Annotations = map[string]string{ociAnnotationRefName: ref}
+	if err := w.writeJSONFile(ociIndexFile, ociIndex{SchemaVersion: 2, MediaType: ociMediaTypeIndex, Manifests: []ociDescriptor{indexDesc}}); err != nil {
+		return &OCIError{Path: dest, Err: err}
+	}
+	if err := w.writeJSONFile(ociLayoutFile, map[string]string{"imageLayoutVersion": "1.0.0"}); err != nil {
+		return &OCIError{Path: dest, Err: err}
+	}
+
+	if strings.HasSuffix(dest, ".tar") {
+		if err := tarDirectory(staging, dest); err != nil {
+			return &OCIError{Path: dest, Err: err}
+		}
+		return nil
+	}
+	// a previous image is replaced, never another directory
+	if _, err := os.Stat(dest); err == nil {
+		if _, err := os.Stat(filepath.Join(dest, ociLayoutFile)); err != nil {
+			return &OCIError{Path: dest, Err: errors.New("the destination exists and is not an OCI image layout")}
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return &OCIError{Path: dest, Err: err}
+		}
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		return &OCIError{Path: dest, Err: err}
+	}
+	return nil
+}
+
+// writeImage writes the image of the binaries for the platform,
+// on top of the image of the base for the same platform, and
+// returns the descriptor of its manifest.
+func (w *ociLayout) writeImage(base *ociLayout, p Platform, binaries []ociBinary, opts OCIOptions) (ociDescriptor, error) {
+	platform := ociPlatform{OS: p.OS, Architecture: p.Arch}
+	if binaries[0].GoArm != "" {
+		platform.Variant = "v" + binaries[0].GoArm
+	}
+	first := binaries[0].Info
+
+	created := time.Unix(0, 0).UTC()
+	if t, err := time.Parse(time.RFC3339, first.BuildDate); err == nil {
+		created = t.UTC()
+	}
+
+	manifest := ociManifest{SchemaVersion: 2, MediaType: ociMediaTypeManifest}
+	config := &ociImageConfig{}
+	if base != nil {
+		var err error
+		manifest.Layers, config, err = base.image(platform)
+		if err != nil {
+			return ociDescriptor{}, fmt.Errorf("error reading the base image %s: %w", opts.Base, err)
+		}
+		for _, l := range manifest.Layers {
+			if err := w.copyBlob(base, l); err != nil {
+				return ociDescriptor{}, err
+			}
+		}
+	}
+
+	layer, diffID, err := w.writeLayer(binaries, created)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	config.Created = created.Format(time.RFC3339)
+	config.OS = platform.OS
+	config.Architecture = platform.Architecture
+	config.Variant = platform.Variant
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	config.History = append(config.History, ociHistory{
+		Created:   config.Created,
+		CreatedBy: "gaia build",
+		Comment:   "reva " + first.RevaVersion,
+	})
+	config.Config.Entrypoint = opts.Entrypoint
+	if len(config.Config.Entrypoint) == 0 {
+		config.Config.Entrypoint = []string{"/" + path.Join(ociBinDir, binaries[0].Name)}
+	}
+	// the arguments of the base are meant for its own entrypoint
+	config.Config.Cmd = nil
+	if config.Config.Labels == nil {
+		config.Config.Labels = make(map[string]string)
+	}
+	labels, err := ociLabels(binaries)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	maps.Copy(config.Config.Labels, labels)
+	maps.Copy(config.Config.Labels, opts.Labels)
+
+	configDesc, err := w.writeJSONBlob(ociMediaTypeConfig, config)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	manifest.Config = configDesc
+	manifest.Annotations = map[string]string{ociAnnotationCreated: config.Created}
+
+	d, err := w.writeJSONBlob(ociMediaTypeManifest, manifest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	d.Platform = &platform
+	return d, nil
+}
+
+// goArm returns the ARM version the binary was built for, empty if unknown.
+func goArm(path string) string {
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "GOARM" {
+			// e.g. 7 or 7,softfloat
+			v, _, _ := strings.Cut(s.Value, ",")
+			return v
+		}
+	}
+	return ""
+}
+
+// ociLabels returns the labels describing the build of the binaries,
+// following the OCI annotations for the ones they define.
+func ociLabels(binaries []ociBinary) (map[string]string, error) {
+	info := binaries[0].Info
+	labels := map[string]string{
+		"org.opencontainers.image.title":   binaries[0].Name,
+		"org.opencontainers.image.version": info.RevaVersion,
+	}
+	if info.GitCommit != "" {
+		labels["org.opencontainers.image.revision"] = info.GitCommit
+	}
+	if info.BuildDate != "" {
+		labels[ociAnnotationCreated] = info.BuildDate
+	}
+	names := make([]string, 0, len(binaries))
+	for _, b := range binaries {
+		names = append(names, b.Name)
+	}
+	labels[gaiaLabelTargets] = strings.Join(names, ",")
+
+	// the description is the same for all the targets but the target itself
+	desc := *info
+	desc.Target = nil
+	desc.Warnings = nil
+	j, err := json.Marshal(desc)
+	if err != nil {
+		return nil, err
+	}
+	labels[gaiaLabelBuildInfo] = string(j)
+	return labels, nil
+}
+
+// ociLayout is an OCI image layout on disk.
+type ociLayout struct {
+	dir string
+	// ref selects the image of the layout, if not the only one.
+	ref string
+	// tmp, if set, is the directory the layout was extracted in.
+	tmp string
+}
+
+// openOCILayout opens the layout in the directory or the tar,
+// optionally followed by :<ref>.
+func openOCILayout(s string) (*ociLayout, error) {
+	p, ref := s, ""
+	if _, err := os.Stat(p); err != nil {
+		if i := strings.LastIndexByte(s, ':'); i > 0 {
+			p, ref = s[:i], s[i+1:]
+		}
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	l := &ociLayout{dir: p, ref: ref}
+	if !fi.IsDir() {
+		if l.tmp, err = os.MkdirTemp("", "gaia-oci-base-*"); err != nil {
+			return nil, err
+		}
+		l.dir = l.tmp
+		if err := untarDirectory(p, l.tmp); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("error extracting %s: %w", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(l.dir, ociLayoutFile)); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("%s is not an OCI image layout", p)
+	}
+	return l, nil
+}
+
+func (l *ociLayout) Close() {
+	if l.tmp != "" {
+		os.RemoveAll(l.tmp)
+	}
+}
+
+func (l *ociLayout) blobPath(digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.ContainsAny(digest, `/\.`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(l.dir, "blobs", alg, hex), nil
+}
+
+func (l *ociLayout) readJSON(d ociDescriptor, v any) error {
+	p, err := l.blobPath(d.Digest)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// image returns the layers and the configuration of the image of the
+// layout for the platform: the one named by the ref, or the only one.
+func (l *ociLayout) image(platform ociPlatform) ([]ociDescriptor, *ociImageConfig, error) {
+	var index ociIndex
+	data, err := os.ReadFile(filepath.Join(l.dir, ociIndexFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, nil, fmt.Errorf("error decoding %s: %w", ociIndexFile, err)
+	}
+
+	var candidates []ociDescriptor
+	for _, d := range index.Manifests {
+		if l.ref == "" || d.Annotations[ociAnnotationRefName] == l.ref {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("no image named %q in the base", l.ref)
+	}
+
+	// an image per platform, either listed in the layout or in a nested index
+	if len(candidates) == 1 && (candidates[0].MediaType == ociMediaTypeIndex || candidates[0].MediaType == dockerMediaTypeList) {
+		var nested ociIndex
+		if err := l.readJSON(candidates[0], &nested); err != nil {
+			return nil, nil, err
+		}
+		candidates = nested.Manifests
+	}
+
+	var manifestDesc *ociDescriptor
+	for i, d := range candidates {
+		p := d.Platform
+		if p == nil {
+			if len(candidates) == 1 {
+				manifestDesc = &candidates[i]
+			}
+			continue
+		}
+		if p.OS == platform.OS && p.Architecture == platform.Architecture && (platform.Variant == "" || p.Variant == platform.Variant) {
+			manifestDesc = &candidates[i]
+			break
+		}
+	}
+	if manifestDesc == nil {
+		return nil, nil, fmt.Errorf("the base has no image for %s/%s", platform.OS, platform.Architecture)
+	}
+
+	var manifest ociManifest
+	if err := l.readJSON(*manifestDesc, &manifest); err != nil {
+		return nil, nil, err
+	}
+	var config ociImageConfig
+	if err := l.readJSON(manifest.Config, &config); err != nil {
+		return nil, nil, err
+	}
+	if config.OS != "" && (config.OS != platform.OS || config.Architecture != platform.Architecture) {
+		return nil, nil, fmt.Errorf("the base image is for %s/%s, not %s/%s", config.OS, config.Architecture, platform.OS, platform.Architecture)
+	}
+	return manifest.Layers, &config, nil
+}
+
+// copyBlob copies the blob from the other layout, checking its digest.
+func (w *ociLayout) copyBlob(from *ociLayout, d ociDescriptor) error {
+	src, err := from.blobPath(d.Digest)
+	if err != nil {
+		return err
+	}
+	dst, err := w.blobPath(d.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	alg, want, _ := strings.Cut(d.Digest, ":")
+	if alg != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %s", alg)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != want {
+		return fmt.Errorf("blob %s of the base is corrupted", d.Digest)
+	}
+	return out.Close()
+}
+
+// writeJSONBlob writes v as a blob, returning its descriptor.
+func (w *ociLayout) writeJSONBlob(mediaType string, v any) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	sum := sha256.Sum256(data)
+	d := ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(data)),
+	}
+	p, err := w.blobPath(d.Digest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return ociDescriptor{}, err
+	}
+	return d, os.WriteFile(p, data, 0644)
+}
+
+func (w *ociLayout) writeJSONFile(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(w.dir, name), data, 0644)
+}
+
+// writeLayer writes the gzipped tar layer holding the binaries, returning
+// its descriptor and the digest of its uncompressed content. The layer
+// only depends on the binaries and the date, so that reproducible builds
+// give reproducible images.
+func (w *ociLayout) writeLayer(binaries []ociBinary, date time.Time) (ociDescriptor, string, error) {
+	tmp, err := os.CreateTemp(w.dir, ".layer-*")
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	compressed := &countingHash{Hash: sha256.New()}
+	uncompressed := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, compressed))
+	tw := tar.NewWriter(io.MultiWriter(gz, uncompressed))
+
+	dir := ""
+	for _, elem := range strings.Split(ociBinDir, "/") {
+		dir = path.Join(dir, elem)
+		hdr := &tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: date}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return ociDescriptor{}, "", err
+		}
+	}
+	for _, b := range binaries {
+		if err := addFileToTar(tw, b.Path, path.Join(ociBinDir, b.Name), 0755, date); err != nil {
+			return ociDescriptor{}, "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+
+	d := ociDescriptor{
+		MediaType: ociMediaTypeLayer,
+		Digest:    "sha256:" + hex.EncodeToString(compressed.Sum(nil)),
+		Size:      compressed.n,
+	}
+	p, err := w.blobPath(d.Digest)
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	return d, "sha256:" + hex.EncodeToString(uncompressed.Sum(nil)), nil
+}
+
+// countingHash is a hash counting the bytes written.
+type countingHash struct {
+	hash.Hash
+	n int64
+}
+
+func (h *countingHash) Write(p []byte) (int, error) {
+	n, err := h.Hash.Write(p)
+	h.n += int64(n)
+	return n, err
+}
+
+// addFileToTar adds the file to the tar as name, owned by root.
+func addFileToTar(tw *tar.Writer, file, name string, mode int64, date time.Time) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: fi.Size(), ModTime: date}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// tarDirectory writes the content of the directory in the tar file,
+// in lexical order.
+func tarDirectory(dir, dest string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".gaia-oci-*"+".tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	tw := tar.NewWriter(tmp)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755})
+		}
+		return addFileToTar(tw, p, name, 0644, time.Time{})
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// untarDirectory extracts the directories and the
+// regular files of the tar file in the directory.
+func untarDirectory(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(path.Clean(strings.TrimPrefix(hdr.Name, "/")))
+		if name == "." || !filepath.IsLocal(name) {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			out, err := os.Create(p)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ParseOCILabels parses labels in the form key=value.
+func ParseOCILabels(l []string) (map[string]string, error) {
+	labels := make(map[string]string, len(l))
+	for _, s := range l {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q: expected key=value", s)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
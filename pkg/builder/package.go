@@ -0,0 +1,448 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/mod/semver"
+)
+
+// PackageFormat is the format of a distribution package.
+type PackageFormat string
+
+const (
+	PackageTarGz PackageFormat = "tar.gz"
+	PackageDeb   PackageFormat = "deb"
+	PackageRPM   PackageFormat = "rpm"
+)
+
+// ParsePackageFormat parses a package format.
+func ParsePackageFormat(s string) (PackageFormat, error) {
+	switch f := PackageFormat(s); f {
+	case PackageTarGz, PackageDeb, PackageRPM:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown package format %q: expected tar.gz, deb or rpm", s)
+}
+
+// DefaultConfigPath is where revad reads its configuration by default.
+const DefaultConfigPath = "/etc/revad/revad.toml"
+
+// PackageOptions configures the package built with Package.
+type PackageOptions struct {
+	Format PackageFormat
+	// Name is the name of the package, the
+	// name of the target of the binary by default.
+	Name string
+	// Maintainer is the maintainer of the package, as Name <email>.
+	Maintainer string
+	// ConfigPath is the configuration file revad is started
+	// with by the systemd unit, DefaultConfigPath by default.
+	ConfigPath string
+	// Config, if set, is a configuration file installed
+	// at ConfigPath, kept on upgrades when changed.
+	Config string
+	// Offline forbids downloading the modules whose license is bundled.
+	Offline bool
+	Log     *zerolog.Logger
+}
+
+// packageFile is a file or a directory installed by a package.
+type packageFile struct {
+	// Path is the absolute path of the file once installed.
+	Path string
+	Mode fs.FileMode
+	Data []byte
+	// Config marks a configuration file, kept on upgrades.
+	Config bool
+	// License marks a license file.
+	License bool
+}
+
+// packageMeta is what a package says about itself.
+type packageMeta struct {
+	Name        string
+	Version     string
+	Release     string
+	Platform    Platform
+	Maintainer  string
+	Summary     string
+	Description string
+	License     string
+	Date        time.Time
+	Files       []packageFile
+}
+
+// PackageFileName returns the conventional file name of the
+// package of the binary described by info.
+func PackageFileName(info *BinaryInfo, opts PackageOptions) string {
+	name := packageName(info, opts)
+	version := packageVersion(info.RevaVersion, info.GitCommit)
+	switch opts.Format {
+	case PackageDeb:
+		return fmt.Sprintf("%s_%s_%s.deb", name, version, debArch(info.Platform.Arch))
+	case PackageRPM:
+		return fmt.Sprintf("%s-%s-%s.%s.rpm", name, version, rpmRelease, rpmArch(info.Platform.Arch))
+	default:
+		return fmt.Sprintf("%s-%s-%s-%s.tar.gz", name, version, info.Platform.OS, info.Platform.Arch)
+	}
+}
+
+// Package packages the binary, built by gaia, in the given format and
+// writes the package to output, by default PackageFileName in the current
+// directory, returning its path. Besides the binary, installed in /usr/bin,
+// the package holds a systemd unit starting revad with the configuration
+// at ConfigPath, that configuration if given, and the licenses of reva
+// and of the plugins, taken from the module cache. The version and the
+// description of the package come from the build information of the binary.
+func Package(ctx context.Context, binary, output string, opts PackageOptions) (string, error) {
+	if opts.Log == nil {
+		l := zerolog.Nop()
+		opts.Log = &l
+	}
+	if opts.ConfigPath == "" {
+		opts.ConfigPath = DefaultConfigPath
+	}
+	if opts.Format == "" {
+		opts.Format = PackageTarGz
+	}
+
+	if opts.Format == PackageDeb && opts.Maintainer == "" {
+		return "", errors.New("deb packages need a maintainer")
+	}
+
+	info, err := Inspect(ctx, binary, opts.Offline, opts.Log)
+	if err != nil {
+		return "", err
+	}
+	if opts.Format != PackageTarGz && info.Platform.OS != "linux" {
+		return "", fmt.Errorf("%s packages are for linux, not %s", opts.Format, info.Platform.OS)
+	}
+
+	meta, err := packageContent(ctx, binary, info, opts)
+	if err != nil {
+		return "", err
+	}
+
+	var data []byte
+	switch opts.Format {
+	case PackageDeb:
+		data, err = buildDeb(meta)
+	case PackageRPM:
+		data, err = buildRPM(meta)
+	default:
+		data, err = buildTarGz(meta)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error building the %s package: %w", opts.Format, err)
+	}
+	if output == "" {
+		output = PackageFileName(info, opts)
+	}
+	return output, os.WriteFile(output, data, 0644)
+}
+
+func packageName(info *BinaryInfo, opts PackageOptions) string {
+	if opts.Name != "" {
+		return opts.Name
+	}
+	if info.Target != nil {
+		return info.Target.Name
+	}
+	return DefaultTarget.Name
+}
+
+// packageVersion returns the version of the package for the reva
+// version: pre-releases and pseudo-versions sort before the release
+// in both deb and rpm when their dashes become tildes.
+func packageVersion(version, commit string) string {
+	if !semver.IsValid(version) {
+		if commit == "" {
+			return "0.0.0"
+		}
+		return "0.0.0~" + commit
+	}
+	v := strings.TrimPrefix(version, "v")
+	v = strings.ReplaceAll(v, "-", "~")
+	return strings.ReplaceAll(v, "+", ".")
+}
+
+// packageContent returns the description and the files of the package.
+func packageContent(ctx context.Context, binary string, info *BinaryInfo, opts PackageOptions) (*packageMeta, error) {
+	name := packageName(info, opts)
+	meta := &packageMeta{
+		Name:       name,
+		Version:    packageVersion(info.RevaVersion, info.GitCommit),
+		Release:    rpmRelease,
+		Platform:   info.Platform,
+		Maintainer: opts.Maintainer,
+		Summary:    "reva " + name + " built by gaia",
+		License:    "Apache-2.0",
+		Date:       time.Unix(0, 0).UTC(),
+	}
+	if t, err := time.Parse(time.RFC3339, info.BuildDate); err == nil {
+		meta.Date = t.UTC()
+	}
+
+	var desc strings.Builder
+	fmt.Fprintf(&desc, "Built from reva %s", info.RevaVersion)
+	if info.GitCommit != "" {
+		fmt.Fprintf(&desc, " (commit %s)", info.GitCommit)
+	}
+	fmt.Fprintf(&desc, " with Go %s", info.GoVersion)
+	if info.BuildDate != "" {
+		fmt.Fprintf(&desc, " on %s", info.BuildDate)
+	}
+	desc.WriteString(".")
+	if len(info.Plugins) != 0 {
+		desc.WriteString("\nPlugins:")
+		for _, p := range info.Plugins {
+			desc.WriteString("\n  " + p.String())
+		}
+	}
+	meta.Description = desc.String()
+
+	bin, err := os.ReadFile(binary)
+	if err != nil {
+		return nil, err
+	}
+	meta.Files = append(meta.Files, packageFile{Path: "/usr/bin/" + name, Mode: 0755, Data: bin})
+
+	// only revad is a service
+	if info.Target == nil {
+		meta.Files = append(meta.Files, packageFile{
+			Path: "/usr/lib/systemd/system/" + name + ".service",
+			Mode: 0644,
+			Data: []byte(systemdUnit(name, opts.ConfigPath)),
+		})
+	}
+
+	meta.Files = append(meta.Files, packageFile{Path: path.Dir(opts.ConfigPath), Mode: fs.ModeDir | 0755})
+	if opts.Config != "" {
+		config, err := os.ReadFile(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		meta.Files = append(meta.Files, packageFile{Path: opts.ConfigPath, Mode: 0644, Data: config, Config: true})
+	}
+
+	licenses, err := bundledLicenses(ctx, info, opts)
+	if err != nil {
+		return nil, err
+	}
+	docDir := "/usr/share/doc/" + name
+	meta.Files = append(meta.Files, packageFile{Path: docDir, Mode: fs.ModeDir | 0755})
+	meta.Files = append(meta.Files, licenses...)
+
+	slices.SortFunc(meta.Files, func(a, b packageFile) int { return strings.Compare(a.Path, b.Path) })
+	return meta, nil
+}
+
+// systemdUnit returns the systemd unit running the binary.
+func systemdUnit(name, config string) string {
+	return `[Unit]
+Description=reva daemon (` + name + `)
+Documentation=https://reva.link
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=/usr/bin/` + name + ` -c ` + config + `
+Restart=on-failure
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`
+}
+
+// bundledLicenses returns the license files of reva and of the plugins, in
+// /usr/share/doc/<name>/licenses/<module>/. Modules without a license
+// file are only reported.
+func bundledLicenses(ctx context.Context, info *BinaryInfo, opts PackageOptions) ([]packageFile, error) {
+	b := &Builder{RevaModule: info.RevaModule, Offline: opts.Offline, Log: opts.Log}
+	if err := b.getWorkspace(); err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	type mod struct {
+		path, version string
+		replace       *Replace
+	}
+	reva := info.RevaModule
+	if reva == "" {
+		reva = RevaModuleForVersion(info.RevaVersion)
+	}
+	mods := []mod{{path: reva, version: info.RevaVersion, replace: info.RevaReplace}}
+	for _, p := range info.Plugins {
+		m := mod{path: p.RepositoryPath, version: p.Version}
+		for _, r := range info.Replacement {
+			if r.From == p.RepositoryPath {
+				m.replace = &r
+			}
+		}
+		mods = append(mods, m)
+	}
+
+	dir := "/usr/share/doc/" + packageName(info, opts) + "/licenses"
+	var files []packageFile
+	for _, m := range mods {
+		var src string
+		switch {
+		case m.replace != nil && m.replace.ToVersion == "":
+			src = m.replace.To
+		default:
+			p, v := m.path, m.version
+			if m.replace != nil {
+				p, v = m.replace.To, m.replace.ToVersion
+			}
+			d, err := b.w.downloadModule(ctx, p, v)
+			if err != nil {
+				opts.Log.Warn().Err(err).Msgf("license of %s not bundled: module not available", m.path)
+				continue
+			}
+			src = d.Dir
+		}
+		license := findLicenseFile(src)
+		if license == "" {
+			opts.Log.Warn().Msgf("license of %s not bundled: no license file found", m.path)
+			continue
+		}
+		data, err := os.ReadFile(license)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, packageFile{
+			Path:    path.Join(dir, m.path, filepath.Base(license)),
+			Mode:    0644,
+			Data:    data,
+			License: true,
+		})
+	}
+	if len(files) != 0 {
+		files = append(files, packageFile{Path: dir, Mode: fs.ModeDir | 0755})
+		for _, f := range files[:len(files)-1] {
+			for d := path.Dir(f.Path); d != dir; d = path.Dir(d) {
+				if !slices.ContainsFunc(files, func(o packageFile) bool { return o.Path == d }) {
+					files = append(files, packageFile{Path: d, Mode: fs.ModeDir | 0755})
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// treeDirs returns all the directories leading to the files,
+// as relative paths ending with a slash, in order.
+func treeDirs(files []packageFile) []string {
+	var dirs []string
+	for _, f := range files {
+		p := strings.TrimPrefix(f.Path, "/")
+		if !f.Mode.IsDir() {
+			p = path.Dir(p)
+		}
+		for d := p; d != "."; d = path.Dir(d) {
+			if !slices.Contains(dirs, d+"/") {
+				dirs = append(dirs, d+"/")
+			}
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// writeTree writes the files in the tar, under the prefix,
+// with all the directories leading to them, owned by root.
+func writeTree(tw *tar.Writer, prefix string, files []packageFile, date time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: prefix, Mode: 0755, ModTime: date}); err != nil {
+		return err
+	}
+	for _, d := range treeDirs(files) {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: prefix + d, Mode: 0755, ModTime: date}); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if f.Mode.IsDir() {
+			continue
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     prefix + strings.TrimPrefix(f.Path, "/"),
+			Mode:     int64(f.Mode.Perm()),
+			Size:     int64(len(f.Data)),
+			ModTime:  date,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// targz returns the gzipped tar of the files.
+func targz(prefix string, files []packageFile, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := writeTree(tw, prefix, files, date); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildTarGz returns a tarball with the files in
+// a directory named after the package.
+func buildTarGz(meta *packageMeta) ([]byte, error) {
+	prefix := fmt.Sprintf("%s-%s-%s-%s/", meta.Name, meta.Version, meta.Platform.OS, meta.Platform.Arch)
+	return targz(prefix, meta.Files, meta.Date)
+}
+
+// installedSize returns the size of the files in bytes.
+func (meta *packageMeta) installedSize() int64 {
+	var n int64
+	for _, f := range meta.Files {
+		n += int64(len(f.Data))
+	}
+	return n
+}
@@ -0,0 +1,109 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// debArch returns the debian architecture of the go one.
+func debArch(arch string) string {
+	switch arch {
+	case "386":
+		return "i386"
+	case "arm":
+		return "armhf"
+	case "ppc64le":
+		return "ppc64el"
+	default:
+		return arch
+	}
+}
+
+// buildDeb returns the .deb package: an ar archive holding
+// the control files and the files to install.
+func buildDeb(meta *packageMeta) ([]byte, error) {
+	var control strings.Builder
+	fmt.Fprintf(&control, "Package: %s\n", meta.Name)
+	fmt.Fprintf(&control, "Version: %s\n", meta.Version)
+	fmt.Fprintf(&control, "Architecture: %s\n", debArch(meta.Platform.Arch))
+	fmt.Fprintf(&control, "Maintainer: %s\n", meta.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (meta.installedSize()+1023)/1024)
+	fmt.Fprintf(&control, "Section: net\n")
+	fmt.Fprintf(&control, "Priority: optional\n")
+	fmt.Fprintf(&control, "Homepage: https://reva.link\n")
+	fmt.Fprintf(&control, "Description: %s\n", meta.Summary)
+	for _, line := range strings.Split(meta.Description, "\n") {
+		if strings.TrimSpace(line) == "" {
+			line = "."
+		}
+		fmt.Fprintf(&control, " %s\n", line)
+	}
+
+	var md5sums, conffiles strings.Builder
+	for _, f := range meta.Files {
+		if f.Mode.IsDir() {
+			continue
+		}
+		sum := md5.Sum(f.Data)
+		fmt.Fprintf(&md5sums, "%s  %s\n", hex.EncodeToString(sum[:]), strings.TrimPrefix(f.Path, "/"))
+		if f.Config {
+			fmt.Fprintf(&conffiles, "%s\n", f.Path)
+		}
+	}
+
+	controlFiles := []packageFile{
+		{Path: "/control", Mode: 0644, Data: []byte(control.String())},
+		{Path: "/md5sums", Mode: 0644, Data: []byte(md5sums.String())},
+	}
+	if conffiles.Len() != 0 {
+		controlFiles = append(controlFiles, packageFile{Path: "/conffiles", Mode: 0644, Data: []byte(conffiles.String())})
+	}
+	controlTar, err := targz("./", controlFiles, meta.Date)
+	if err != nil {
+		return nil, err
+	}
+	dataTar, err := targz("./", meta.Files, meta.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	mtime := meta.Date.Unix()
+	for _, m := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", dataTar},
+	} {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", m.name, mtime, 0, 0, 0100644, len(m.data))
+		buf.Write(m.data)
+		if len(m.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
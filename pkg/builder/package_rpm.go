@@ -0,0 +1,426 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// rpmRelease is the release of the rpm packages.
+const rpmRelease = "1"
+
+// rpmArch returns the rpm architecture of the go one.
+func rpmArch(arch string) string {
+	switch arch {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "386":
+		return "i686"
+	case "arm":
+		return "armv7hl"
+	default:
+		return arch
+	}
+}
+
+// tags and types of the rpm headers, see the rpm file format
+// in the documentation of rpm.
+const (
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+	rpmTagHeaderI18NTable  = 100
+
+	rpmSigTagSHA1        = 269
+	rpmSigTagSHA256      = 273
+	rpmSigTagSize        = 1000
+	rpmSigTagMD5         = 1004
+	rpmSigTagPayloadSize = 1007
+
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+
+	rpmFileConfig    = 1 << 0
+	rpmFileNoReplace = 1 << 4
+	rpmFileLicense   = 1 << 7
+
+	rpmSenseLess   = 1 << 1
+	rpmSenseEqual  = 1 << 3
+	rpmSenseRPMLib = 1 << 24
+
+	rpmDigestSHA256 = 8
+)
+
+// rpmEntry is an entry of an rpm header.
+type rpmEntry struct {
+	tag, typ int32
+	count    int32
+	data     []byte
+	align    int
+}
+
+// rpmHeader is an rpm header being built.
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+func (h *rpmHeader) addString(tag int32, s string) {
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: rpmTypeString, count: 1, data: []byte(s + "\x00")})
+}
+
+func (h *rpmHeader) addI18NString(tag int32, s string) {
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: rpmTypeI18NString, count: 1, data: []byte(s + "\x00")})
+}
+
+func (h *rpmHeader) addStrings(tag int32, l []string) {
+	var data []byte
+	for _, s := range l {
+		data = append(append(data, s...), 0)
+	}
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: rpmTypeStringArray, count: int32(len(l)), data: data})
+}
+
+func (h *rpmHeader) addInt32(tag int32, l ...int32) {
+	data := make([]byte, 0, 4*len(l))
+	for _, v := range l {
+		data = binary.BigEndian.AppendUint32(data, uint32(v))
+	}
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: rpmTypeInt32, count: int32(len(l)), data: data, align: 4})
+}
+
+func (h *rpmHeader) addInt16(tag int32, l ...int16) {
+	data := make([]byte, 0, 2*len(l))
+	for _, v := range l {
+		data = binary.BigEndian.AppendUint16(data, uint16(v))
+	}
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: rpmTypeInt16, count: int32(len(l)), data: data, align: 2})
+}
+
+func (h *rpmHeader) addBin(tag int32, b []byte) {
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: rpmTypeBin, count: int32(len(b)), data: b})
+}
+
+// marshal returns the header, with its entries in a region
+// marked by the given tag, as rpm expects it.
+func (h *rpmHeader) marshal(region int32) []byte {
+	entries := slices.Clone(h.entries)
+	slices.SortStableFunc(entries, func(a, b rpmEntry) int { return int(a.tag - b.tag) })
+
+	var store []byte
+	offsets := make([]int32, len(entries))
+	for i, e := range entries {
+		if e.align > 1 {
+			for len(store)%e.align != 0 {
+				store = append(store, 0)
+			}
+		}
+		offsets[i] = int32(len(store))
+		store = append(store, e.data...)
+	}
+
+	// the trailer of the region closes the store, pointing back to the index
+	n := int32(len(entries) + 1)
+	trailer := int32(len(store))
+	store = binary.BigEndian.AppendUint32(store, uint32(region))
+	store = binary.BigEndian.AppendUint32(store, rpmTypeBin)
+	store = binary.BigEndian.AppendUint32(store, uint32(-n*16))
+	store = binary.BigEndian.AppendUint32(store, 16)
+
+	out := []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}
+	out = binary.BigEndian.AppendUint32(out, uint32(n))
+	out = binary.BigEndian.AppendUint32(out, uint32(len(store)))
+	appendEntry := func(tag, typ, offset, count int32) {
+		out = binary.BigEndian.AppendUint32(out, uint32(tag))
+		out = binary.BigEndian.AppendUint32(out, uint32(typ))
+		out = binary.BigEndian.AppendUint32(out, uint32(offset))
+		out = binary.BigEndian.AppendUint32(out, uint32(count))
+	}
+	appendEntry(region, rpmTypeBin, trailer, 16)
+	for i, e := range entries {
+		appendEntry(e.tag, e.typ, offsets[i], e.count)
+	}
+	return append(out, store...)
+}
+
+// buildRPM returns the .rpm package: the lead, the signature
+// header, the header and the gzipped cpio payload.
+func buildRPM(meta *packageMeta) ([]byte, error) {
+	mtime := int32(meta.Date.Unix())
+
+	var dirs []string
+	var (
+		sizes                       []int32
+		modes, rdevs                []int16
+		mtimes, flags, dirIndexes   []int32
+		devices, inodes             []int32
+		digests, linktos, basenames []string
+		users, groups, langs        []string
+		total                       int64
+	)
+	var payload bytes.Buffer
+	cpio := &cpioWriter{w: &payload}
+	for i, f := range meta.Files {
+		dir, base := path.Split(f.Path)
+		idx := slices.Index(dirs, dir)
+		if idx == -1 {
+			dirs = append(dirs, dir)
+			idx = len(dirs) - 1
+		}
+		mode := int64(f.Mode.Perm()) | 0100000
+		digest := ""
+		if f.Mode.IsDir() {
+			mode = int64(f.Mode.Perm()) | 040000
+		} else {
+			sum := sha256.Sum256(f.Data)
+			digest = hex.EncodeToString(sum[:])
+		}
+		var flag int32
+		switch {
+		case f.Config:
+			flag = rpmFileConfig | rpmFileNoReplace
+		case f.License:
+			flag = rpmFileLicense
+		}
+
+		sizes = append(sizes, int32(len(f.Data)))
+		modes = append(modes, int16(mode))
+		rdevs = append(rdevs, 0)
+		mtimes = append(mtimes, mtime)
+		digests = append(digests, digest)
+		linktos = append(linktos, "")
+		flags = append(flags, flag)
+		users = append(users, "root")
+		groups = append(groups, "root")
+		devices = append(devices, 1)
+		inodes = append(inodes, int32(i+1))
+		langs = append(langs, "")
+		dirIndexes = append(dirIndexes, int32(idx))
+		basenames = append(basenames, base)
+		total += int64(len(f.Data))
+
+		if err := cpio.writeFile("."+f.Path, i+1, mode, mtime, f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := cpio.close(); err != nil {
+		return nil, err
+	}
+	payloadSize := payload.Len()
+
+	var compressed bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(payload.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	evr := meta.Version + "-" + meta.Release
+	h := &rpmHeader{}
+	h.addStrings(rpmTagHeaderI18NTable, []string{"C"})
+	h.addString(rpmTagName, meta.Name)
+	h.addString(rpmTagVersion, meta.Version)
+	h.addString(rpmTagRelease, meta.Release)
+	h.addI18NString(rpmTagSummary, meta.Summary)
+	h.addI18NString(rpmTagDescription, meta.Description)
+	h.addInt32(rpmTagBuildTime, mtime)
+	h.addString(rpmTagBuildHost, "gaia")
+	h.addInt32(rpmTagSize, int32(total))
+	h.addString(rpmTagLicense, meta.License)
+	if meta.Maintainer != "" {
+		h.addString(rpmTagPackager, meta.Maintainer)
+	}
+	h.addI18NString(rpmTagGroup, "Unspecified")
+	h.addString(rpmTagURL, "https://reva.link")
+	h.addString(rpmTagOS, "linux")
+	h.addString(rpmTagArch, rpmArch(meta.Platform.Arch))
+	// without a source rpm, the package would be taken for one
+	h.addString(rpmTagSourceRPM, meta.Name+"-"+evr+".src.rpm")
+	h.addInt32(rpmTagFileSizes, sizes...)
+	h.addInt16(rpmTagFileModes, modes...)
+	h.addInt16(rpmTagFileRDevs, rdevs...)
+	h.addInt32(rpmTagFileMTimes, mtimes...)
+	h.addStrings(rpmTagFileDigests, digests)
+	h.addStrings(rpmTagFileLinkTos, linktos)
+	h.addInt32(rpmTagFileFlags, flags...)
+	h.addStrings(rpmTagFileUserName, users)
+	h.addStrings(rpmTagFileGroupName, groups)
+	h.addInt32(rpmTagFileDevices, devices...)
+	h.addInt32(rpmTagFileInodes, inodes...)
+	h.addStrings(rpmTagFileLangs, langs)
+	h.addInt32(rpmTagDirIndexes, dirIndexes...)
+	h.addStrings(rpmTagBaseNames, basenames)
+	h.addStrings(rpmTagDirNames, dirs)
+	h.addInt32(rpmTagFileDigestAlgo, rpmDigestSHA256)
+	h.addStrings(rpmTagProvideName, []string{meta.Name})
+	h.addInt32(rpmTagProvideFlags, rpmSenseEqual)
+	h.addStrings(rpmTagProvideVersion, []string{evr})
+	rpmlib := []struct{ name, version string }{
+		{"rpmlib(CompressedFileNames)", "3.0.4-1"},
+		{"rpmlib(FileDigests)", "4.6.0-1"},
+		{"rpmlib(PayloadFilesHavePrefix)", "4.0-1"},
+	}
+	var reqNames, reqVersions []string
+	var reqFlags []int32
+	for _, r := range rpmlib {
+		reqNames = append(reqNames, r.name)
+		reqVersions = append(reqVersions, r.version)
+		reqFlags = append(reqFlags, rpmSenseLess|rpmSenseEqual|rpmSenseRPMLib)
+	}
+	h.addStrings(rpmTagRequireName, reqNames)
+	h.addInt32(rpmTagRequireFlags, reqFlags...)
+	h.addStrings(rpmTagRequireVersion, reqVersions)
+	h.addString(rpmTagPayloadFormat, "cpio")
+	h.addString(rpmTagPayloadCompressor, "gzip")
+	h.addString(rpmTagPayloadFlags, "9")
+	header := h.marshal(rpmTagHeaderImmutable)
+
+	sha1Sum := sha1.Sum(header)
+	sha256Sum := sha256.Sum256(header)
+	md5Sum := md5.New()
+	md5Sum.Write(header)
+	md5Sum.Write(compressed.Bytes())
+	sig := &rpmHeader{}
+	sig.addString(rpmSigTagSHA1, hex.EncodeToString(sha1Sum[:]))
+	sig.addString(rpmSigTagSHA256, hex.EncodeToString(sha256Sum[:]))
+	sig.addInt32(rpmSigTagSize, int32(len(header)+compressed.Len()))
+	sig.addBin(rpmSigTagMD5, md5Sum.Sum(nil))
+	sig.addInt32(rpmSigTagPayloadSize, int32(payloadSize))
+	signature := sig.marshal(rpmTagHeaderSignatures)
+
+	var out bytes.Buffer
+	out.Write(rpmLead(meta.Name + "-" + evr))
+	out.Write(signature)
+	// the header starts on an 8 bytes boundary
+	out.Write(make([]byte, (8-len(signature)%8)%8))
+	out.Write(header)
+	out.Write(compressed.Bytes())
+	return out.Bytes(), nil
+}
+
+// rpmLead returns the lead of a binary rpm, only kept for compatibility.
+func rpmLead(name string) []byte {
+	lead := []byte{0xed, 0xab, 0xee, 0xdb, 3, 0}
+	lead = binary.BigEndian.AppendUint16(lead, 0) // binary package
+	lead = binary.BigEndian.AppendUint16(lead, 0) // architecture, unused
+	n := make([]byte, 66)
+	copy(n[:65], name)
+	lead = append(lead, n...)
+	lead = binary.BigEndian.AppendUint16(lead, 1) // linux
+	lead = binary.BigEndian.AppendUint16(lead, 5) // signature in a header
+	return append(lead, make([]byte, 16)...)
+}
+
+// cpioWriter writes a cpio archive in the new ascii format.
+type cpioWriter struct {
+	w *bytes.Buffer
+}
+
+func (c *cpioWriter) header(name string, ino int, mode int64, mtime int32, size int) {
+	nlink := 1
+	if mode&040000 != 0 {
+		nlink = 2
+	}
+	fmt.Fprintf(c.w, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		ino, mode, 0, 0, nlink, mtime, size, 0, 0, 0, 0, len(name)+1, 0)
+	c.w.WriteString(name)
+	c.w.WriteByte(0)
+	c.pad()
+}
+
+func (c *cpioWriter) pad() {
+	for c.w.Len()%4 != 0 {
+		c.w.WriteByte(0)
+	}
+}
+
+func (c *cpioWriter) writeFile(name string, ino int, mode int64, mtime int32, data []byte) error {
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	c.header(name, ino, mode, mtime, len(data))
+	c.w.Write(data)
+	c.pad()
+	return nil
+}
+
+func (c *cpioWriter) close() error {
+	c.header("TRAILER!!!", 0, 0, 0, 0)
+	return nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBuilderID identifies gaia as the builder
+	// in the provenance, when no other id is configured.
+	DefaultBuilderID = "https://github.com/cs3org/gaia"
+
+	inTotoStatementType  = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType   = "https://slsa.dev/provenance/v1"
+	gaiaBuildType        = "https://github.com/cs3org/gaia/buildtypes/reva/v1"
+	provenanceFileSuffix = ".intoto.json"
+)
+
+// Statement is an in-toto statement carrying
+// the SLSA provenance of a built binary.
+type Statement struct {
+	Type          string     `json:"_type"`
+	Subject       []Subject  `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     Provenance `json:"predicate"`
+}
+
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Provenance is a SLSA v1 provenance predicate.
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+type BuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   ExternalParameters   `json:"externalParameters"`
+	InternalParameters   InternalParameters   `json:"internalParameters"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// ExternalParameters are the inputs of the build
+// chosen by whoever requested it.
+type ExternalParameters struct {
+	RevaVersion string      `json:"revaVersion"`
+	Plugins     []string    `json:"plugins,omitempty"`
+	Replace     []string    `json:"replace,omitempty"`
+	Platform    string      `json:"platform"`
+	Tags        []string    `json:"tags,omitempty"`
+	LdFlags     string      `json:"ldflags,omitempty"`
+	Debug       bool        `json:"debug,omitempty"`
+	Static      bool        `json:"static,omitempty"`
+	StaticMusl  bool        `json:"staticMusl,omitempty"`
+	CToolchain  *CToolchain `json:"cToolchain,omitempty"`
+	Vendor      bool        `json:"vendor,omitempty"`
+	Hooks       []string    `json:"hooks,omitempty"`
+}
+
+// InternalParameters are the parameters
+// set by gaia for the build.
+type InternalParameters struct {
+	GoVersion  string   `json:"goVersion"`
+	BuildFlags []string `json:"buildFlags"`
+}
+
+type ResourceDescriptor struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type RunDetails struct {
+	Builder  BuilderInfo   `json:"builder"`
+	Metadata BuildMetadata `json:"metadata"`
+}
+
+type BuilderInfo struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type BuildMetadata struct {
+	StartedOn  time.Time `json:"startedOn"`
+	FinishedOn time.Time `json:"finishedOn"`
+}
+
+// ProvenancePath returns the path where the provenance
+// of the binary written to output is stored.
+func ProvenancePath(output string) string {
+	return output + provenanceFileSuffix
+}
+
+// FileSHA256 returns the hex encoded sha256 digest of a file.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// provenance returns the provenance statement of the binary
+// built for the given platform with the given go build arguments.
+func (b *Builder) provenance(ctx context.Context, p Platform, output string, args buildArgs, started time.Time) (*Statement, error) {
+	digest, err := FileSHA256(output)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := b.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deps := make([]ResourceDescriptor, 0, len(lock.Modules))
+	for _, m := range lock.Modules {
+		d := ResourceDescriptor{URI: modulePURL(m.Path, m.Version)}
+		// the go.sum dirhash of the module, not a digest of its zip
+		if strings.HasPrefix(m.Sum, "h1:") {
+			d.Digest = map[string]string{"goModuleH1": m.Sum}
+		}
+		deps = append(deps, d)
+	}
+
+	plugins := make([]string, 0, len(b.Plugins))
+	for _, plugin := range b.Plugins {
+		// as requested, the version chosen being in the dependencies
+		plugins = append(plugins, plugin.String())
+	}
+	replace := make([]string, 0, len(b.Replacement))
+	for _, r := range b.Replacement {
+		replace = append(replace, r.Format())
+	}
+
+	var tags []string
+	if t := formatOptionArgument(args["-tags"]); t != "" {
+		tags = strings.Split(t, ",")
+	}
+	tc, err := b.cToolchain(p)
+	if err != nil {
+		return nil, err
+	}
+
+	builderID := b.BuilderID
+	if builderID == "" {
+		builderID = DefaultBuilderID
+	}
+
+	return &Statement{
+		Type: inTotoStatementType,
+		Subject: []Subject{
+			{Name: filepath.Base(output), Digest: map[string]string{"sha256": digest}},
+		},
+		PredicateType: slsaProvenanceType,
+		Predicate: Provenance{
+			BuildDefinition: BuildDefinition{
+				BuildType: gaiaBuildType,
+				ExternalParameters: ExternalParameters{
+					RevaVersion: b.RevaVersion,
+					Plugins:     plugins,
+					Replace:     replace,
+					Platform:    p.String(),
+					Tags:        tags,
+					LdFlags:     b.LdFlags,
+					Debug:       b.Debug,
+					Static:      b.Static,
+					StaticMusl:  b.StaticMusl,
+					CToolchain:  tc,
+					Vendor:      b.Vendor,
+					Hooks:       b.hookStrings(func(HookPoint) bool { return true }),
+				},
+				InternalParameters: InternalParameters{
+					GoVersion:  b.w.goVer,
+					BuildFlags: args.Format(),
+				},
+				ResolvedDependencies: deps,
+			},
+			RunDetails: RunDetails{
+				Builder: BuilderInfo{
+					ID:      builderID,
+					Version: map[string]string{"gaia": gaiaVersion()},
+				},
+				Metadata: BuildMetadata{
+					StartedOn:  started.UTC(),
+					FinishedOn: time.Now().UTC(),
+				},
+			},
+		},
+	}, nil
+}
+
+// writeProvenance stores the provenance of the binary next to it.
+func (b *Builder) writeProvenance(ctx context.Context, p Platform, output string, args buildArgs, started time.Time) error {
+	st, err := b.provenance(ctx, p, output, args, started)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := ProvenancePath(output)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	b.Log.Info().Msgf("provenance written to %s", path)
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Recipe is a declarative description of a reva build,
+// usually checked in as a gaia.toml or gaia.yaml file.
+type Recipe struct {
+	RevaVersion  string   `toml:"reva_version,omitempty" yaml:"reva_version,omitempty"`
+	RevaModule   string   `toml:"reva_module,omitempty" yaml:"reva_module,omitempty"`
+	With         []string `toml:"with,omitempty" yaml:"with,omitempty"`
+	Tags         []string `toml:"tags,omitempty" yaml:"tags,omitempty"`
+	LdFlags      string   `toml:"ldflags,omitempty" yaml:"ldflags,omitempty"`
+	Debug        bool     `toml:"debug,omitempty" yaml:"debug,omitempty"`
+	Static       bool     `toml:"static,omitempty" yaml:"static,omitempty"`
+	StaticMusl   bool     `toml:"static_musl,omitempty" yaml:"static_musl,omitempty"`
+	Vendor       bool     `toml:"vendor,omitempty" yaml:"vendor,omitempty"`
+	Reproducible bool     `toml:"reproducible,omitempty" yaml:"reproducible,omitempty"`
+	GoVersion    string   `toml:"go_version,omitempty" yaml:"go_version,omitempty"`
+	Template     string   `toml:"template,omitempty" yaml:"template,omitempty"`
+	Targets      []string `toml:"targets,omitempty" yaml:"targets,omitempty"`
+	Platforms    []string `toml:"platforms,omitempty" yaml:"platforms,omitempty"`
+	Output       string   `toml:"output,omitempty" yaml:"output,omitempty"`
+	// CC are the C toolchains by os/arch, or "*" for every platform.
+	CC map[string]CToolchain `toml:"cc,omitempty" yaml:"cc,omitempty"`
+	// Hooks are the shell commands run at each point
+	// of the build, e.g. post-get or post-compile.
+	Hooks map[string][]string `toml:"hooks,omitempty" yaml:"hooks,omitempty"`
+}
+
+// RecipeFormat is the serialization format of a recipe.
+type RecipeFormat string
+
+const (
+	RecipeTOML RecipeFormat = "toml"
+	RecipeYAML RecipeFormat = "yaml"
+)
+
+// RecipeFormatFromPath infers the recipe format from
+// the extension of the file.
+func RecipeFormatFromPath(path string) (RecipeFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return RecipeTOML, nil
+	case ".yaml", ".yml":
+		return RecipeYAML, nil
+	default:
+		return "", fmt.Errorf("unknown recipe format for file %s: expected .toml, .yaml or .yml", path)
+	}
+}
+
+// LoadRecipe reads the recipe stored in the given file.
+func LoadRecipe(path string) (*Recipe, error) {
+	format, err := RecipeFormatFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := DecodeRecipe(bytes.NewReader(data), format)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding recipe %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// DecodeRecipe decodes a recipe in the given format.
+// Unknown fields are rejected, so that typos do not
+// silently produce a different build.
+func DecodeRecipe(r io.Reader, format RecipeFormat) (*Recipe, error) {
+	var recipe Recipe
+	switch format {
+	case RecipeTOML:
+		dec := toml.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&recipe); err != nil {
+			return nil, err
+		}
+	case RecipeYAML:
+		dec := yaml.NewDecoder(r)
+		dec.KnownFields(true)
+		if err := dec.Decode(&recipe); err != nil && err != io.EOF {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown recipe format %q", format)
+	}
+	return &recipe, nil
+}
+
+// Encode writes the recipe in the given format.
+func (r *Recipe) Encode(w io.Writer, format RecipeFormat) error {
+	switch format {
+	case RecipeTOML:
+		return toml.NewEncoder(w).Encode(r)
+	case RecipeYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("unknown recipe format %q", format)
+	}
+}
+
+// CToolchains returns the C toolchains declared in the recipe, by platform.
+func (r *Recipe) CToolchains() (map[Platform]CToolchain, error) {
+	if len(r.CC) == 0 {
+		return nil, nil
+	}
+	toolchains := make(map[Platform]CToolchain, len(r.CC))
+	for platform, tc := range r.CC {
+		var p Platform
+		if platform != allPlatforms {
+			var err error
+			if p, err = ParsePlatform(platform); err != nil {
+				return nil, fmt.Errorf("invalid C toolchain: %w", err)
+			}
+		}
+		toolchains[p] = tc
+	}
+	return toolchains, nil
+}
+
+// BuildHooks returns the hooks declared in the recipe, in the
+// order of their points in the build and then in the recipe.
+func (r *Recipe) BuildHooks() ([]Hook, error) {
+	for point := range r.Hooks {
+		if _, err := ParseHookPoint(point); err != nil {
+			return nil, err
+		}
+	}
+	var hooks []Hook
+	for _, stage := range Stages {
+		for _, point := range []HookPoint{PreStage(stage), PostStage(stage)} {
+			for _, command := range r.Hooks[string(point)] {
+				hooks = append(hooks, Hook{Point: point, Command: command})
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// allPlatforms is the platform of the recipe
+// C toolchain applying to every platform.
+const allPlatforms = "*"
+
+// Plugins returns the plugins and the replacements
+// declared in the recipe.
+func (r *Recipe) Plugins() ([]Plugin, []Replace) {
+	return ParsePluginReplacement(r.With)
+}
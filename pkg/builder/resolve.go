@@ -0,0 +1,367 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// CompatibleVersion is the version of a plugin selecting its
+// highest version that can be built with the requested reva.
+const CompatibleVersion = "compatible"
+
+// IsVersionRange returns true if the version of a plugin is a range, or
+// compatible, resolved by gaia rather than passed to the go command: ^ and
+// ~ ranges, several comparators, comparisons and partial versions without
+// the v prefix, and partial versions such as v1.2. The comparisons the
+// go command understands, such as <v1.2.0 or >=v1.0.0, are left to it.
+func IsVersionRange(v string) bool {
+	if v == CompatibleVersion || len(strings.Fields(v)) > 1 {
+		return true
+	}
+	op, rest := cutOperator(strings.TrimSpace(v))
+	switch op {
+	case "":
+		p, err := parsePartialVersion(rest)
+		return err == nil && (p.n < 3 || !strings.HasPrefix(rest, "v"))
+	case ">=", "<=", ">", "<":
+		return !strings.HasPrefix(rest, "v")
+	default:
+		return true
+	}
+}
+
+// cutOperator splits the comparator of a range
+// into its operator, if any, and its version.
+func cutOperator(s string) (string, string) {
+	for _, op := range []string{"^", "~", ">=", "<=", ">", "<", "="} {
+		if rest, ok := strings.CutPrefix(s, op); ok {
+			return op, rest
+		}
+	}
+	return "", s
+}
+
+// VersionRange is a range of semantic versions: the comparators
+// (>=1.0, <2, =1.2.3, ...) separated by spaces a version must all
+// satisfy, with the ^1.2 and ~1.4.0 shorthands. Partial versions
+// are completed with zeros. Pre-releases never match.
+type VersionRange struct {
+	raw         string
+	comparators []comparator
+}
+
+type comparator struct {
+	op      string
+	version string
+}
+
+// ParseVersionRange parses a range of semantic versions, e.g.
+// ^1.2, ~1.4.0 or ">=1.0 <2". The v prefix is optional.
+func ParseVersionRange(s string) (*VersionRange, error) {
+	r := &VersionRange{raw: s}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid version range %q: empty", s)
+	}
+	for _, f := range fields {
+		op, version := cutOperator(f)
+		v, err := parsePartialVersion(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version range %q: %w", s, err)
+		}
+		r.comparators = append(r.comparators, v.comparators(op)...)
+	}
+	return r, nil
+}
+
+// Match returns true if the version is in the range.
+func (r *VersionRange) Match(v string) bool {
+	if !semver.IsValid(v) || semver.Prerelease(v) != "" {
+		return false
+	}
+	for _, c := range r.comparators {
+		cmp := semver.Compare(v, c.version)
+		var ok bool
+		switch c.op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *VersionRange) String() string { return r.raw }
+
+// partialVersion is a version where only the first
+// n of major, minor and patch may be given.
+type partialVersion struct {
+	parts [3]int
+	n     int
+}
+
+func parsePartialVersion(s string) (partialVersion, error) {
+	var v partialVersion
+	fields := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if s == "" || len(fields) > 3 {
+		return v, fmt.Errorf("%q is not a version", s)
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			if strings.Contains(f, "-") {
+				return v, fmt.Errorf("%q: pre-releases are not supported in ranges", s)
+			}
+			return v, fmt.Errorf("%q is not a version", s)
+		}
+		v.parts[i] = n
+	}
+	v.n = len(fields)
+	return v, nil
+}
+
+func (v partialVersion) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.parts[0], v.parts[1], v.parts[2])
+}
+
+// bump returns the first version after all the ones
+// matching the i-th part of v, e.g. v1.3.0 for 1.2 and i=1.
+func (v partialVersion) bump(i int) partialVersion {
+	b := partialVersion{n: 3}
+	copy(b.parts[:i], v.parts[:i])
+	b.parts[i] = v.parts[i] + 1
+	return b
+}
+
+// comparators returns the comparators of the operator applied to v.
+func (v partialVersion) comparators(op string) []comparator {
+	low := comparator{">=", v.String()}
+	// the part incremented for the upper bound of the partial version
+	last := v.n - 1
+	switch op {
+	case "^":
+		// the leftmost non zero part given may not change
+		i := 0
+		for i < last && v.parts[i] == 0 {
+			i++
+		}
+		return []comparator{low, {"<", v.bump(i).String()}}
+	case "~":
+		// the patch may change, or the minor if not given
+		return []comparator{low, {"<", v.bump(min(last, 1)).String()}}
+	case ">":
+		return []comparator{{">=", v.bump(last).String()}}
+	case ">=":
+		return []comparator{low}
+	case "<":
+		return []comparator{{"<", v.String()}}
+	case "<=":
+		return []comparator{{"<", v.bump(last).String()}}
+	default:
+		if v.n == 3 {
+			return []comparator{{"=", v.String()}}
+		}
+		return []comparator{low, {"<", v.bump(last).String()}}
+	}
+}
+
+// PluginResolution is the version chosen by gaia
+// for a plugin requested with a range or compatible.
+type PluginResolution struct {
+	Plugin    string `json:"plugin"`
+	Requested string `json:"requested"`
+	Version   string `json:"version"`
+}
+
+// resolvePlugins chooses, for the plugins requested with a range, the
+// highest version matching it that can be built with the requested reva,
+// the plugins keeping the range. With a lock, the locked versions are
+// checked against the ranges instead, see applyLock.
+func (b *Builder) resolvePlugins(ctx context.Context) error {
+	unresolved := func(p Plugin) bool {
+		return IsVersionRange(p.Version) && b.pluginVersion(p) == p.Version
+	}
+	if b.Locked != nil || !slices.ContainsFunc(b.Plugins, unresolved) {
+		return nil
+	}
+
+	reva, _ := b.resolveRevaRequirements(ctx)
+	for _, p := range b.Plugins {
+		if !unresolved(p) {
+			continue
+		}
+		version, err := b.resolvePlugin(ctx, p, reva)
+		if err != nil {
+			return err
+		}
+		if reva != "" {
+			b.Log.Info().Msgf("plugin %s resolved to %s, the highest version compatible with reva %s", p, version, reva)
+		} else {
+			b.Log.Info().Msgf("plugin %s resolved to %s", p, version)
+		}
+		b.resolved = append(b.resolved, PluginResolution{Plugin: p.RepositoryPath, Requested: p.Version, Version: version})
+	}
+	return nil
+}
+
+// Resolutions returns the versions chosen by Prepare
+// for the plugins requested with a range or compatible.
+func (b *Builder) Resolutions() []PluginResolution {
+	return b.resolved
+}
+
+// pluginVersion returns the version the plugin is fetched at:
+// the one chosen for its range, or the one requested.
+func (b *Builder) pluginVersion(p Plugin) string {
+	return resolvedVersion(p, b.resolved)
+}
+
+func resolvedVersion(p Plugin, resolved []PluginResolution) string {
+	for _, r := range resolved {
+		if r.Plugin == p.RepositoryPath && r.Requested == p.Version {
+			return r.Version
+		}
+	}
+	return p.Version
+}
+
+// resolvedPlugins returns the plugins at the version they are fetched at.
+func resolvedPlugins(plugins []Plugin, resolved []PluginResolution) []Plugin {
+	out := make([]Plugin, 0, len(plugins))
+	for _, p := range plugins {
+		out = append(out, Plugin{RepositoryPath: p.RepositoryPath, Version: resolvedVersion(p, resolved)})
+	}
+	return out
+}
+
+// resolvePlugin returns the highest version of the plugin in its range
+// that can be built with reva, or the highest one in the range if the
+// version of reva is not known in advance.
+func (b *Builder) resolvePlugin(ctx context.Context, p Plugin, reva string) (string, error) {
+	var r *VersionRange
+	if p.Version != CompatibleVersion {
+		var err error
+		if r, err = ParseVersionRange(p.Version); err != nil {
+			return "", err
+		}
+	}
+
+	versions, err := b.w.listVersions(ctx, p.RepositoryPath, b.Offline)
+	if err != nil {
+		return "", &ModuleFetchError{Module: p.RepositoryPath, Version: p.Version, Err: err}
+	}
+	var candidates []string
+	for _, v := range versions {
+		if r != nil && r.Match(v) || r == nil && semver.Prerelease(v) == "" {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("%w: no version of %s matches %s", ErrVersionNotFound, p.RepositoryPath, p.Version)
+	}
+	semver.Sort(candidates)
+	if reva == "" || !semver.IsValid(reva) {
+		b.Log.Warn().Msgf("the version of reva is not known in advance: the compatibility of %s is not checked", p)
+		return candidates[len(candidates)-1], nil
+	}
+
+	for _, v := range slices.Backward(candidates) {
+		reason, err := b.w.incompatibility(ctx, p.RepositoryPath, v, reva)
+		if err != nil {
+			return "", &ModuleFetchError{Module: p.RepositoryPath, Version: v, Err: err}
+		}
+		if reason == "" {
+			return v, nil
+		}
+		b.Log.Debug().Msgf("skipping %s@%s: %s", p.RepositoryPath, v, reason)
+	}
+	return "", fmt.Errorf("%w: no version of %s matching %s can be built with reva %s", ErrIncompatiblePlugins, p.RepositoryPath, p.Version, reva)
+}
+
+// listVersions returns the versions of the module known to the module
+// proxy or, offline, the ones in the module cache.
+func (w *workspace) listVersions(ctx context.Context, path string, offline bool) ([]string, error) {
+	c := w.clone()
+	if offline {
+		gomodcache, err := c.outputGoCommand(ctx, "env", "GOMODCACHE")
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(string(bytes.TrimSpace(gomodcache)), "cache", "download")
+		c.setEnvKV("GOPROXY", "file://"+filepath.ToSlash(dir))
+	}
+	out, err := c.outputGoCommand(ctx, "list", "-m", "-versions", "-json", path)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Versions []string
+	}
+	if err := json.Unmarshal(out, &m); err != nil {
+		return nil, fmt.Errorf("error decoding the versions of %s: %w", path, err)
+	}
+	return m.Versions, nil
+}
+
+// incompatibility returns why the version of the module cannot be built
+// with the reva version, empty if it can: it requires a newer reva, or
+// another major version of reva.
+func (w *workspace) incompatibility(ctx context.Context, path, version, reva string) (string, error) {
+	out, err := w.outputGoCommand(ctx, "list", "-m", "-json", path+"@"+version)
+	if err != nil {
+		return "", err
+	}
+	var m Module
+	if err := json.Unmarshal(out, &m); err != nil {
+		return "", fmt.Errorf("error decoding module %s@%s: %w", path, version, err)
+	}
+	gomod, err := parseGoModFile(ctx, m.GoMod)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range gomod.Require {
+		switch {
+		case r.Path == w.reva:
+			if semver.Compare(r.Version, reva) > 0 {
+				return "requires reva " + r.Version, nil
+			}
+		case isRevaModule(r.Path):
+			return "requires " + r.Path, nil
+		}
+	}
+	return "", nil
+}
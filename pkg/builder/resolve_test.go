@@ -0,0 +1,153 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import "testing"
+
+func TestIsVersionRange(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"compatible", true},
+		{"^1.2", true},
+		{"^v1.2.3", true},
+		{"~1.4.0", true},
+		{">=1.0 <2", true},
+		{">=v1.0.0 <v2.0.0", true},
+		{">=1.0", true},
+		{"<2", true},
+		{"=1.2.3", true},
+		{"=v1.2.3", true},
+		{"1.2", true},
+		{"1.2.3", true},
+		{"v1", true},
+		{"v1.2", true},
+		// left to the go command
+		{"", false},
+		{"v1.2.3", false},
+		{"<v1.2.0", false},
+		{"<=v1.2.0", false},
+		{">v1.0.0", false},
+		{">=v1.0.0", false},
+		{"latest", false},
+		{"upgrade", false},
+		{"main", false},
+		{"v1.2.3-rc.1", false},
+		{"v0.0.0-20240101000000-abcdefabcdef", false},
+	}
+	for _, tt := range tests {
+		if got := IsVersionRange(tt.version); got != tt.want {
+			t.Errorf("IsVersionRange(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseVersionRange(t *testing.T) {
+	tests := []struct {
+		rng      string
+		match    []string
+		mismatch []string
+	}{
+		{
+			rng:      "^1.2",
+			match:    []string{"v1.2.0", "v1.2.9", "v1.9.0"},
+			mismatch: []string{"v1.1.9", "v2.0.0", "v1.3.0-rc.1"},
+		},
+		{
+			rng:      "^0.2.3",
+			match:    []string{"v0.2.3", "v0.2.9"},
+			mismatch: []string{"v0.2.2", "v0.3.0", "v1.0.0"},
+		},
+		{
+			rng:      "^0.0.3",
+			match:    []string{"v0.0.3"},
+			mismatch: []string{"v0.0.4", "v0.1.0"},
+		},
+		{
+			rng:      "~1.4.0",
+			match:    []string{"v1.4.0", "v1.4.7"},
+			mismatch: []string{"v1.3.9", "v1.5.0"},
+		},
+		{
+			rng:      "~1",
+			match:    []string{"v1.0.0", "v1.9.9"},
+			mismatch: []string{"v0.9.0", "v2.0.0"},
+		},
+		{
+			rng:      ">=1.0 <2",
+			match:    []string{"v1.0.0", "v1.99.0"},
+			mismatch: []string{"v0.9.9", "v2.0.0"},
+		},
+		{
+			rng:      ">1.2",
+			match:    []string{"v1.3.0", "v2.0.0"},
+			mismatch: []string{"v1.2.0", "v1.2.9"},
+		},
+		{
+			rng:      "<=1.2",
+			match:    []string{"v1.0.0", "v1.2.9"},
+			mismatch: []string{"v1.3.0"},
+		},
+		{
+			rng:      "=1.2.3",
+			match:    []string{"v1.2.3"},
+			mismatch: []string{"v1.2.4", "v1.2.2"},
+		},
+		{
+			rng:      "v1.2",
+			match:    []string{"v1.2.0", "v1.2.5"},
+			mismatch: []string{"v1.3.0", "v1.1.0"},
+		},
+		{
+			rng:      "v1",
+			match:    []string{"v1.0.0", "v1.5.2"},
+			mismatch: []string{"v2.0.0", "v0.1.0"},
+		},
+		{
+			rng:      "^1.2",
+			mismatch: []string{"invalid", "", "1.2.0"},
+		},
+	}
+	for _, tt := range tests {
+		r, err := ParseVersionRange(tt.rng)
+		if err != nil {
+			t.Errorf("ParseVersionRange(%q): %v", tt.rng, err)
+			continue
+		}
+		for _, v := range tt.match {
+			if !r.Match(v) {
+				t.Errorf("%q does not match %s", tt.rng, v)
+			}
+		}
+		for _, v := range tt.mismatch {
+			if r.Match(v) {
+				t.Errorf("%q matches %s", tt.rng, v)
+			}
+		}
+	}
+}
+
+func TestParseVersionRangeErrors(t *testing.T) {
+	for _, rng := range []string{"", " ", "^", ">=1.x", "1.2.3.4", "^1.2.0-rc.1", "~a", ">=-1"} {
+		if r, err := ParseVersionRange(rng); err == nil {
+			t.Errorf("ParseVersionRange(%q) = %v, want an error", rng, r)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// SBOM is a CycloneDX software bill of materials
+// describing a reva build.
+type SBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     SBOMMetadata    `json:"metadata"`
+	Components   []SBOMComponent `json:"components"`
+	Dependencies []SBOMDep       `json:"dependencies,omitempty"`
+}
+
+type SBOMMetadata struct {
+	Timestamp string          `json:"timestamp"`
+	Tools     []SBOMComponent `json:"tools,omitempty"`
+	Component SBOMComponent   `json:"component"`
+}
+
+type SBOMComponent struct {
+	Type       string          `json:"type"`
+	BOMRef     string          `json:"bom-ref,omitempty"`
+	Name       string          `json:"name"`
+	Version    string          `json:"version,omitempty"`
+	PURL       string          `json:"purl,omitempty"`
+	Hashes     []SBOMHash      `json:"hashes,omitempty"`
+	Licenses   []SBOMLicense   `json:"licenses,omitempty"`
+	Properties []SBOMProperty  `json:"properties,omitempty"`
+	Components []SBOMComponent `json:"components,omitempty"`
+}
+
+type SBOMHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type SBOMLicense struct {
+	License struct {
+		ID string `json:"id"`
+	} `json:"license"`
+}
+
+type SBOMProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type SBOMDep struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+func modulePURL(path, version string) string {
+	purl := "pkg:golang/" + path
+	if version != "" {
+		purl += "@" + version
+	}
+	return purl
+}
+
+// SBOM returns the bill of materials of the prepared workspace,
+// listing reva, the plugins and every transitive module.
+func (b *Builder) SBOM(ctx context.Context) (*SBOM, error) {
+	if b.w == nil {
+		if err := b.getWorkspace(); err != nil {
+			return nil, err
+		}
+	}
+
+	modules, err := b.w.listModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := readGoSum(filepath.Join(b.w.folder, "go.sum"))
+	if err != nil {
+		return nil, err
+	}
+
+	sbom := &SBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: SBOMMetadata{
+			Tools: []SBOMComponent{
+				{Type: "application", Name: "gaia", Version: gaiaVersion()},
+			},
+		},
+	}
+	var revaVersion string
+
+	refs := make(map[string]string, len(modules)) // path@version -> bom-ref
+	for _, m := range modules {
+		c := SBOMComponent{
+			Type:    "library",
+			Name:    m.Path,
+			Version: m.Version,
+			PURL:    modulePURL(m.Path, m.Version),
+		}
+		c.BOMRef = c.PURL
+
+		sumPath, sumVersion, dir := m.Path, m.Version, m.Dir
+		if m.Replace != nil {
+			replace := m.Replace.Path
+			if m.Replace.Version != "" {
+				replace += "@" + m.Replace.Version
+				sumPath, sumVersion = m.Replace.Path, m.Replace.Version
+			} else {
+				sumPath = ""
+			}
+			if m.Replace.Dir != "" {
+				dir = m.Replace.Dir
+			}
+			c.Properties = append(c.Properties, SBOMProperty{Name: "gaia:replace", Value: replace})
+		}
+
+		if sumPath != "" {
+			// the go.sum hash is a dirhash of the module, not a digest of a file
+			if h, ok := sums[sumPath+" "+sumVersion]; ok {
+				c.Properties = append(c.Properties, SBOMProperty{Name: "gaia:go.sum", Value: h})
+			}
+			if hash, ok := b.w.moduleZipSHA256(sumPath, sumVersion); ok {
+				c.Hashes = append(c.Hashes, SBOMHash{Alg: "SHA-256", Content: hash})
+			}
+		}
+		if id := detectLicense(dir); id != "" {
+			var l SBOMLicense
+			l.License.ID = id
+			c.Licenses = append(c.Licenses, l)
+		}
+
+		switch {
+		case m.Path == b.w.reva:
+			c.Properties = append(c.Properties, SBOMProperty{Name: "gaia:role", Value: "reva"})
+			revaVersion = m.Version
+		case b.isPlugin(m.Path):
+			c.Properties = append(c.Properties, SBOMProperty{Name: "gaia:role", Value: "plugin"})
+		}
+
+		refs[m.Path+"@"+m.Version] = c.BOMRef
+		sbom.Components = append(sbom.Components, c)
+	}
+
+	sbom.Metadata.Component = b.sbomTargets(revaVersion)
+
+	// a reproducible build has a reproducible bill of materials
+	if b.Reproducible {
+		date, err := b.w.getBuildDate(ctx, revaVersion, b.Replacement, true)
+		if err != nil {
+			return nil, err
+		}
+		inputs, err := b.prepareInputs()
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(inputs.hash()))
+		sbom.Metadata.Timestamp = date.UTC().Format(time.RFC3339)
+		sbom.SerialNumber = "urn:uuid:" + hashUUID(sum[:])
+	} else {
+		serial, err := newUUID()
+		if err != nil {
+			return nil, err
+		}
+		sbom.Metadata.Timestamp = time.Now().UTC().Format(time.RFC3339)
+		sbom.SerialNumber = "urn:uuid:" + serial
+	}
+
+	sbom.Dependencies, err = b.sbomDependencies(ctx, refs, sbom.Metadata.Component.BOMRef)
+	if err != nil {
+		return nil, err
+	}
+	return sbom, nil
+}
+
+// sbomTargets returns the component the bill of materials describes:
+// the binary of the target, or the build of several targets, each one
+// being one of its components.
+func (b *Builder) sbomTargets(version string) SBOMComponent {
+	var binaries []SBOMComponent
+	for _, t := range b.targets() {
+		binaries = append(binaries, SBOMComponent{
+			Type:       "application",
+			BOMRef:     t.Name,
+			Name:       t.Name,
+			Version:    version,
+			Properties: []SBOMProperty{{Name: "gaia:package", Value: path.Join(b.w.reva, t.Package)}},
+		})
+	}
+	if len(binaries) == 1 {
+		return binaries[0]
+	}
+	names := make([]string, 0, len(binaries))
+	for _, c := range binaries {
+		names = append(names, c.Name)
+	}
+	return SBOMComponent{
+		Type:       "application",
+		BOMRef:     strings.Join(names, "+"),
+		Name:       strings.Join(names, "+"),
+		Version:    version,
+		Components: binaries,
+	}
+}
+
+// WriteSBOM writes the bill of materials of the
+// prepared workspace as CycloneDX JSON.
+func (b *Builder) WriteSBOM(ctx context.Context, w io.Writer) error {
+	sbom, err := b.SBOM(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sbom)
+}
+
+// isPlugin returns true if the module provides one of the plugins.
+func (b *Builder) isPlugin(module string) bool {
+	for _, p := range b.Plugins {
+		if p.RepositoryPath == module || strings.HasPrefix(p.RepositoryPath, module+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sbomDependencies builds the dependency graph of the selected
+// modules from the output of go mod graph.
+func (b *Builder) sbomDependencies(ctx context.Context, refs map[string]string, root string) ([]SBOMDep, error) {
+	out, err := b.w.outputGoCommand(ctx, "mod", "graph")
+	if err != nil {
+		return nil, err
+	}
+
+	deps := make(map[string][]string)
+	var order []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		from, to, ok := strings.Cut(s.Text(), " ")
+		if !ok {
+			continue
+		}
+		toRef, ok := refs[to]
+		if !ok {
+			// not a selected version
+			continue
+		}
+		fromRef := root
+		if strings.Contains(from, "@") {
+			if fromRef, ok = refs[from]; !ok {
+				continue
+			}
+		}
+		if _, ok := deps[fromRef]; !ok {
+			order = append(order, fromRef)
+		}
+		deps[fromRef] = append(deps[fromRef], toRef)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make([]SBOMDep, 0, len(order))
+	for _, ref := range order {
+		res = append(res, SBOMDep{Ref: ref, DependsOn: deps[ref]})
+	}
+	return res, nil
+}
+
+// moduleZipSHA256 returns the SHA-256 digest of the zip of
+// the module version in the module cache, if it is there.
+func (w *workspace) moduleZipSHA256(path, version string) (string, bool) {
+	escPath, err := module.EscapePath(path)
+	if err != nil {
+		return "", false
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", false
+	}
+	gomodcache := envValue(w.goenv, "GOMODCACHE")
+	if gomodcache == "" {
+		return "", false
+	}
+	sum, err := FileSHA256(filepath.Join(gomodcache, "cache", "download", escPath, "@v", escVersion+".zip"))
+	if err != nil {
+		return "", false
+	}
+	return sum, true
+}
+
+var licenseFiles = []string{"LICENSE", "LICENSE.md", "LICENSE.txt", "LICENCE", "LICENCE.md", "COPYING", "License", "license"}
+
+// findLicenseFile returns the path of the license
+// file in the given module directory, if any.
+func findLicenseFile(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	for _, name := range licenseFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// detectLicense returns the SPDX identifier of the license
+// found in the module directory, or an empty string if
+// it cannot be recognised.
+func detectLicense(dir string) string {
+	path := findLicenseFile(dir)
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return classifyLicense(string(data))
+}
+
+func classifyLicense(text string) string {
+	t := strings.Join(strings.Fields(text), " ")
+	has := func(s ...string) bool {
+		for _, e := range s {
+			if !strings.Contains(t, e) {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case has("Apache License", "Version 2.0"):
+		return "Apache-2.0"
+	case has("Mozilla Public License", "2.0"):
+		return "MPL-2.0"
+	case has("GNU LESSER GENERAL PUBLIC LICENSE", "Version 3"):
+		return "LGPL-3.0-only"
+	case has("GNU GENERAL PUBLIC LICENSE", "Version 3"):
+		return "GPL-3.0-only"
+	case has("GNU GENERAL PUBLIC LICENSE", "Version 2"):
+		return "GPL-2.0-only"
+	case has("GNU AFFERO GENERAL PUBLIC LICENSE"):
+		return "AGPL-3.0-only"
+	case has("Permission is hereby granted, free of charge"):
+		return "MIT"
+	case has("Permission to use, copy, modify, and/or distribute this software for any purpose"),
+		has("ISC License"):
+		return "ISC"
+	case has("Redistribution and use in source and binary forms", "Neither the name"):
+		return "BSD-3-Clause"
+	case has("Redistribution and use in source and binary forms"):
+		return "BSD-2-Clause"
+	case has("This is free and unencumbered software released into the public domain"):
+		return "Unlicense"
+	default:
+		return ""
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	return formatUUID(u), nil
+}
+
+// hashUUID returns the UUID made of the first bytes of the
+// hash, as a custom (version 8) UUID of RFC 9562.
+func hashUUID(hash []byte) string {
+	var u [16]byte
+	copy(u[:], hash)
+	u[6] = (u[6] & 0x0f) | 0x80
+	return formatUUID(u)
+}
+
+func formatUUID(u [16]byte) string {
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
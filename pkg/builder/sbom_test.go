@@ -0,0 +1,56 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import "testing"
+
+func TestClassifyLicense(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"apache", "\n                                 Apache License\n                           Version 2.0, January 2004\n", "Apache-2.0"},
+		{"mpl", "Mozilla Public License Version 2.0\n==================================\n", "MPL-2.0"},
+		{"lgpl", "                   GNU LESSER GENERAL PUBLIC LICENSE\n                       Version 3, 29 June 2007\n", "LGPL-3.0-only"},
+		{"gpl 3", "                    GNU GENERAL PUBLIC LICENSE\n                       Version 3, 29 June 2007\n", "GPL-3.0-only"},
+		{"gpl 2", "                    GNU GENERAL PUBLIC LICENSE\n                       Version 2, June 1991\n", "GPL-2.0-only"},
+		{"agpl", "                    GNU AFFERO GENERAL PUBLIC LICENSE\n                       Version 3, 19 November 2007\n", "AGPL-3.0-only"},
+		{"mit", "MIT License\n\nPermission is hereby granted, free of charge, to any person obtaining a copy\n", "MIT"},
+		{"isc", "Permission to use, copy, modify, and/or distribute this software for any\npurpose with or without fee is hereby granted", "ISC"},
+		{"isc title", "ISC License\n\nCopyright (c) 2015", "ISC"},
+		{
+			"bsd 3",
+			"Redistribution and use in source and binary forms, with or without\nmodification, are permitted ...\n" +
+				"   * Neither the name of Google Inc. nor the names of its\ncontributors may be used",
+			"BSD-3-Clause",
+		},
+		{"bsd 2", "Redistribution and use in source and binary forms, with or without\nmodification, are permitted", "BSD-2-Clause"},
+		{"unlicense", "This is free and unencumbered software released into the public domain.\n", "Unlicense"},
+		{"unknown", "All rights reserved.", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyLicense(tt.text); got != tt.want {
+				t.Errorf("classifyLicense() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
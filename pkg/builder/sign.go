@@ -0,0 +1,181 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBadSignature is returned when a binary does not match
+// its signature or its checksum.
+var ErrBadSignature = errors.New("bad signature")
+
+const (
+	checksumFileSuffix  = ".sha256"
+	signatureFileSuffix = ".sig"
+)
+
+// ChecksumPath returns the path of the checksum file of the binary,
+// in the format of sha256sum.
+func ChecksumPath(output string) string {
+	return output + checksumFileSuffix
+}
+
+// SignaturePath returns the path of the detached signature of the binary:
+// the raw ed25519 signature of its content.
+func SignaturePath(output string) string {
+	return output + signatureFileSuffix
+}
+
+// ReadPrivateKey reads an ed25519 private key
+// in a PKCS #8 PEM file, as written by openssl.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the private key %s: %w", path, err)
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+	}
+	return k, nil
+}
+
+// ReadPublicKey reads an ed25519 public key
+// in a PKIX PEM file, as written by openssl.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKey(path, der)
+}
+
+// ParsePublicKey parses an ed25519 public key in PEM.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+	return parsePublicKey("the public key", block.Bytes)
+}
+
+func parsePublicKey(name string, der []byte) (ed25519.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", name, err)
+	}
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", name)
+	}
+	return k, nil
+}
+
+// MarshalPublicKey returns the public key in PEM.
+func MarshalPublicKey(key ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func readPEM(path, typ string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded %s", path, strings.ToLower(typ))
+	}
+	return block.Bytes, nil
+}
+
+// SignFile writes the checksum file and the detached
+// signature of the binary next to it.
+func SignFile(path string, key ed25519.PrivateKey) error {
+	checksum, signature, err := Sign(path, key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ChecksumPath(path), checksum, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(SignaturePath(path), signature, 0644)
+}
+
+// Sign returns the content of the checksum file and
+// the detached signature of the binary.
+func Sign(path string, key ed25519.PrivateKey) ([]byte, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(data)
+	checksum := []byte(hex.EncodeToString(sum[:]) + "  " + filepath.Base(path) + "\n")
+	return checksum, ed25519.Sign(key, data), nil
+}
+
+// VerifyFile checks the detached signature of the binary, in sig or,
+// if empty, next to it, and its checksum file if there is one.
+func VerifyFile(path, sig string, key ed25519.PublicKey) error {
+	if sig == "" {
+		sig = SignaturePath(path)
+	}
+	signature, err := os.ReadFile(sig)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("%w: %s was not signed with this key, or was modified", ErrBadSignature, path)
+	}
+
+	checksum, err := os.ReadFile(ChecksumPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	want, _, _ := strings.Cut(string(checksum), " ")
+	if want != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("%w: %s does not match the checksum in %s", ErrBadSignature, path, ChecksumPath(path))
+	}
+	return nil
+}
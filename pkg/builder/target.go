@@ -0,0 +1,157 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Target is a reva command built with the plugins.
+type Target struct {
+	// Name names the binary.
+	Name string `json:"name"`
+	// Package is the path, in the reva module, of the
+	// package of the command, exposing a Main function.
+	Package string `json:"package"`
+	// Variables is the path, in the reva module, of the package
+	// the version variables are injected in. Defaults to Package.
+	Variables string `json:"variables,omitempty"`
+}
+
+// DefaultTarget is revad, built when no target is given.
+var DefaultTarget = Target{Name: "revad", Package: "cmd/revad"}
+
+// ParseTarget parses a target in the form name[=package[:variables]],
+// where the package defaults to cmd/<name>.
+func ParseTarget(s string) (Target, error) {
+	name, pkg, _ := strings.Cut(s, "=")
+	pkg, vars, _ := strings.Cut(pkg, ":")
+	if name == "" || strings.ContainsAny(name, `/\ `) || name == "." || name == ".." {
+		return Target{}, fmt.Errorf("invalid target %q: expected name[=package[:variables]]", s)
+	}
+	if pkg == "" {
+		pkg = "cmd/" + name
+	}
+	t := Target{Name: name, Package: path.Clean(pkg)}
+	if vars != "" && path.Clean(vars) != t.Package {
+		t.Variables = path.Clean(vars)
+	}
+	for _, p := range []string{t.Package, t.Variables} {
+		if strings.HasPrefix(p, "/") || strings.HasPrefix(p, "..") {
+			return Target{}, fmt.Errorf("invalid target %q: the packages are relative to the reva module", s)
+		}
+	}
+	return t, nil
+}
+
+// ParseTargets parses a list of targets.
+func ParseTargets(l []string) ([]Target, error) {
+	targets := make([]Target, 0, len(l))
+	for _, s := range l {
+		t, err := ParseTarget(s)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(targets, func(o Target) bool { return o.Name == t.Name }) {
+			return nil, fmt.Errorf("target %s given twice", t.Name)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func (t Target) String() string {
+	if t.Package == "cmd/"+t.Name && t.Variables == "" {
+		return t.Name
+	}
+	s := t.Name + "=" + t.Package
+	if t.Variables != "" {
+		s += ":" + t.Variables
+	}
+	return s
+}
+
+// ImportPath returns the import path of the
+// command package in the given reva module.
+func (t Target) ImportPath(reva string) string {
+	return reva + "/" + t.Package
+}
+
+// VariablesPath returns the import path of the package the
+// version variables are injected in, in the given reva module.
+func (t Target) VariablesPath(reva string) string {
+	if t.Variables == "" {
+		return t.ImportPath(reva)
+	}
+	return reva + "/" + t.Variables
+}
+
+// mainDir returns the directory of the workspace holding the main
+// package of the target: revad keeps the main.go at the root.
+func (t Target) mainDir() string {
+	if t == DefaultTarget {
+		return "."
+	}
+	return filepath.Join(targetsDir, t.Name)
+}
+
+// targetsDir is the directory of the workspace
+// holding the main packages of the targets.
+const targetsDir = "targets"
+
+// targets returns the targets to build.
+func (b *Builder) targets() []Target {
+	if len(b.Targets) == 0 {
+		return []Target{DefaultTarget}
+	}
+	return b.Targets
+}
+
+// variablesPaths returns the packages the version
+// variables of the targets are injected in.
+func (b *Builder) variablesPaths() []string {
+	var paths []string
+	for _, t := range b.targets() {
+		if p := t.VariablesPath(b.w.reva); !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// TargetOutput returns the path of the binary of the target: the output
+// itself when building a single target, otherwise the target name in the
+// directory of the output.
+func (b *Builder) TargetOutput(output string, t Target) string {
+	if len(b.targets()) == 1 {
+		return output
+	}
+	return filepath.Join(filepath.Dir(output), t.Name)
+}
+
+// Artifact is a binary built for a target and a platform.
+type Artifact struct {
+	Target   Target
+	Platform Platform
+	Path     string
+}
@@ -0,0 +1,59 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import "testing"
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Target
+	}{
+		{"revad", Target{Name: "revad", Package: "cmd/revad"}},
+		{"reva=cmd/reva", Target{Name: "reva", Package: "cmd/reva"}},
+		{"cli=cmd/reva/", Target{Name: "cli", Package: "cmd/reva"}},
+		{"cli=tools/cli:pkg/version", Target{Name: "cli", Package: "tools/cli", Variables: "pkg/version"}},
+		{"cli=tools/cli:tools/cli", Target{Name: "cli", Package: "tools/cli"}},
+		{"cli=./tools/cli", Target{Name: "cli", Package: "tools/cli"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.in)
+		if err != nil {
+			t.Errorf("ParseTarget(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTarget(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTargetErrors(t *testing.T) {
+	for _, in := range []string{"", "=cmd/revad", "cmd/revad", `a\b`, "a b", ".", "..", "x=/abs", "x=../outside", "x=cmd/x:../v"} {
+		if got, err := ParseTarget(in); err == nil {
+			t.Errorf("ParseTarget(%q) = %+v, want an error", in, got)
+		}
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	if _, err := ParseTargets([]string{"revad", "reva", "revad=cmd/other"}); err == nil {
+		t.Error("ParseTargets accepted the same target twice")
+	}
+}
@@ -4,18 +4,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
 	"text/template"
 
 	"github.com/cs3org/gaia/internal/utils"
 )
 
 type Plugin struct {
-	RepositoryPath string
-	Version        string
+	RepositoryPath string `json:"path"`
+	Version        string `json:"version,omitempty"`
 }
 
 func (p Plugin) String() string {
@@ -26,10 +33,67 @@ func (p Plugin) String() string {
 	return s
 }
 
+// ParsePlugin parses a plugin in the form module[@version].
+func ParsePlugin(s string) Plugin {
+	var p Plugin
+	split := strings.SplitN(s, "@", 2)
+	p.RepositoryPath = split[0]
+	if len(split) > 1 {
+		p.Version = split[1]
+	}
+	return p
+}
+
+// ParsePluginReplacement parses a list of plugins in the form
+// module[@version][=replacement[@version]], returning the plugins
+// and the replacements to apply.
+func ParsePluginReplacement(l []string) ([]Plugin, []Replace) {
+	var plugins []Plugin
+	var replacement []Replace
+	for _, e := range l {
+		plugin, replace, ok := cutReplacement(e)
+		p := ParsePlugin(plugin)
+		plugins = append(plugins, p)
+
+		if ok {
+			replacement = append(replacement, parseReplace(p, replace))
+		}
+	}
+	return plugins, replacement
+}
+
+// cutReplacement splits module[@version][=replacement] at the
+// equal sign of the replacement, skipping the ones of the version
+// ranges, e.g. in module@>=1.2 or module@=1.2.3.
+func cutReplacement(s string) (string, string, bool) {
+	at := strings.Index(s, "@")
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			continue
+		}
+		if at >= 0 && i > at && strings.ContainsRune("@<> ", rune(s[i-1])) {
+			continue
+		}
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+func parseReplace(p Plugin, s string) Replace {
+	var r Replace
+	r.From = p.RepositoryPath
+	split := strings.SplitN(s, "@", 2)
+	r.To = split[0]
+	if len(split) > 1 {
+		r.ToVersion = split[1]
+	}
+	return r
+}
+
 type Replace struct {
-	From      string
-	To        string
-	ToVersion string
+	From      string `json:"from"`
+	To        string `json:"to"`
+	ToVersion string `json:"to_version,omitempty"`
 }
 
 // Format formats the replacement string to be valid
@@ -50,15 +114,151 @@ func (r Replace) String() string {
 	return s
 }
 
-func writeMainWithPlugins(f *os.File, plugins []Plugin) error {
-	plugins = slices.DeleteFunc(plugins, func(p Plugin) bool { return p.RepositoryPath == revaRepository })
-	return mainTemplate.Execute(f, struct {
-		Plugins  []Plugin
-		RevaRepo string
-	}{
-		Plugins:  plugins,
-		RevaRepo: revaRepository,
-	})
+// MainData is the data the main.go template is executed with.
+type MainData struct {
+	// Plugins are the plugins to import, reva excluded.
+	Plugins []Plugin
+	// RevaRepo is the module path of reva.
+	RevaRepo string
+	// Target is the reva command built.
+	Target Target
+	// Command is the import path of the package of
+	// the target, exposing the Main function.
+	Command string
+	// Info describes the build. Until the modules
+	// are resolved, it holds the requested versions.
+	Info *BinaryInfo
+	// BuildInfo is the quoted description of the build, empty until the
+	// modules are resolved. The markers around it, BuildInfoBegin and
+	// BuildInfoEnd bytes long, let gaia inspect find it in the binary.
+	BuildInfo      string
+	BuildInfoBegin int
+	BuildInfoEnd   int
+}
+
+// mainTemplate returns the template of the main.go,
+// the custom one if set, and its name.
+func (b *Builder) mainTemplate() (*template.Template, string, error) {
+	if b.Template == "" {
+		return mainTemplate, "built-in", nil
+	}
+	data, err := os.ReadFile(b.Template)
+	if err != nil {
+		return nil, b.Template, &TemplateError{Template: b.Template, Err: err}
+	}
+	t, err := template.New(filepath.Base(b.Template)).Parse(string(data))
+	if err != nil {
+		return nil, b.Template, &TemplateError{Template: b.Template, Err: err}
+	}
+	return t, b.Template, nil
+}
+
+// templateDigest returns the sha256 digest of the
+// custom template, empty when using the built-in one.
+func (b *Builder) templateDigest() (string, error) {
+	if b.Template == "" {
+		return "", nil
+	}
+	d, err := FileSHA256(b.Template)
+	if err != nil {
+		return "", &TemplateError{Template: b.Template, Err: err}
+	}
+	return d, nil
+}
+
+// writeMain writes the main.go of the target importing the plugins, rendered from the
+// template and checked before being used. When embed is set, the
+// description of the build is embedded between buildInfoBegin and
+// buildInfoEnd, and printed by revad when run with -gaia-build-info.
+func (b *Builder) writeMain(t Target, info *BinaryInfo, embed bool) error {
+	tmpl, name, err := b.mainTemplate()
+	if err != nil {
+		return err
+	}
+
+	data := MainData{
+		Plugins:        slices.DeleteFunc(slices.Clone(b.Plugins), func(p Plugin) bool { return p.RepositoryPath == b.w.reva }),
+		RevaRepo:       b.w.reva,
+		Target:         t,
+		Command:        t.ImportPath(b.w.reva),
+		Info:           info,
+		BuildInfoBegin: len(buildInfoBegin),
+		BuildInfoEnd:   len(buildInfoEnd),
+	}
+	if embed {
+		j, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		data.BuildInfo = strconv.Quote(buildInfoBegin + string(j) + buildInfoEnd)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return &TemplateError{Template: name, Err: err}
+	}
+	if err := checkMain(buf.Bytes(), data.Command, data.Plugins); err != nil {
+		return &TemplateError{Template: name, Err: err}
+	}
+
+	if err := os.MkdirAll(filepath.Join(b.w.folder, t.mainDir()), 0755); err != nil {
+		return err
+	}
+	f, err := b.w.CreateFile(filepath.Join(t.mainDir(), "main.go"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkMain checks that the rendered main.go is a valid main
+// package, importing the command of the target and all the plugins.
+func checkMain(src []byte, command string, plugins []Plugin) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", src, parser.AllErrors)
+	if err != nil {
+		return fmt.Errorf("the rendered main.go is not valid Go: %w", err)
+	}
+	if file.Name.Name != "main" {
+		return fmt.Errorf("the rendered main.go is in package %s instead of main", file.Name.Name)
+	}
+	if !slices.ContainsFunc(file.Decls, func(d ast.Decl) bool {
+		fn, ok := d.(*ast.FuncDecl)
+		return ok && fn.Recv == nil && fn.Name.Name == "main"
+	}) {
+		return errors.New("the rendered main.go does not declare the main function")
+	}
+
+	imports := make(map[string]bool, len(file.Imports))
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			return err
+		}
+		imports[path] = true
+	}
+	var missing []string
+	for _, pkg := range append([]string{command}, pluginPaths(plugins)...) {
+		if !imports[pkg] {
+			missing = append(missing, pkg)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("the rendered main.go does not import %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func pluginPaths(plugins []Plugin) []string {
+	paths := make([]string, 0, len(plugins))
+	for _, p := range plugins {
+		paths = append(paths, p.RepositoryPath)
+	}
+	return paths
 }
 
 type GoMod struct {
@@ -101,9 +301,9 @@ func parseGoModFile(ctx context.Context, path string) (*GoMod, error) {
 	return &gomod, nil
 }
 
-func isRevaLocalReplacement(repl []Replace) (string, bool) {
+func isRevaLocalReplacement(reva string, repl []Replace) (string, bool) {
 	for _, r := range repl {
-		if r.From == revaRepository {
+		if r.From == reva {
 			_, err := os.Stat(r.To)
 			return r.To, err == nil
 		}
@@ -114,13 +314,28 @@ func isRevaLocalReplacement(repl []Replace) (string, bool) {
 var mainTemplate = template.Must(template.New("main.go").Parse(`package main
 
 import (
-	revadcmd "{{.RevaRepo}}/cmd/revad"
+{{- if .BuildInfo }}
+	"fmt"
+	"os"
+{{ end }}
+	revadcmd "{{ .Command }}"
 {{- range .Plugins }}
 	_ "{{ .RepositoryPath }}"
 {{- end }}
 )
-
+{{ if .BuildInfo }}
+// gaiaBuildInfo describes how gaia built this binary.
+// It is a variable, so that the markers are kept in the binary.
+var gaiaBuildInfo = {{ .BuildInfo }}
+{{ end }}
 func main() {
+{{- if .BuildInfo }}
+	if len(os.Args) == 2 && os.Args[1] == "-gaia-build-info" {
+		// strip the markers, without repeating them in the binary
+		fmt.Println(gaiaBuildInfo[{{ .BuildInfoBegin }} : len(gaiaBuildInfo)-{{ .BuildInfoEnd }}])
+		return
+	}
+{{- end }}
 	revadcmd.Main()
 }
 `))
@@ -0,0 +1,72 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCutReplacement(t *testing.T) {
+	tests := []struct {
+		in      string
+		plugin  string
+		replace string
+		ok      bool
+	}{
+		{"example.org/plugin", "example.org/plugin", "", false},
+		{"example.org/plugin@v1.2.0", "example.org/plugin@v1.2.0", "", false},
+		{"example.org/plugin=../plugin", "example.org/plugin", "../plugin", true},
+		{"example.org/plugin@v1.2.0=example.org/fork@v1.2.1", "example.org/plugin@v1.2.0", "example.org/fork@v1.2.1", true},
+		{"example.org/plugin@>=1.2", "example.org/plugin@>=1.2", "", false},
+		{"example.org/plugin@<=1.2=../plugin", "example.org/plugin@<=1.2", "../plugin", true},
+		{"example.org/plugin@=1.2.3", "example.org/plugin@=1.2.3", "", false},
+		{"example.org/plugin@>=1.0 <=2=../plugin", "example.org/plugin@>=1.0 <=2", "../plugin", true},
+		{"example.org/plugin@^1.2=/src/plugin", "example.org/plugin@^1.2", "/src/plugin", true},
+	}
+	for _, tt := range tests {
+		plugin, replace, ok := cutReplacement(tt.in)
+		if plugin != tt.plugin || replace != tt.replace || ok != tt.ok {
+			t.Errorf("cutReplacement(%q) = %q, %q, %v, want %q, %q, %v", tt.in, plugin, replace, ok, tt.plugin, tt.replace, tt.ok)
+		}
+	}
+}
+
+func TestParsePluginReplacement(t *testing.T) {
+	plugins, replacement := ParsePluginReplacement([]string{
+		"example.org/a@^1.2",
+		"example.org/b@v1.0.0=example.org/fork@v1.0.1",
+		"example.org/c=../c",
+	})
+	wantPlugins := []Plugin{
+		{RepositoryPath: "example.org/a", Version: "^1.2"},
+		{RepositoryPath: "example.org/b", Version: "v1.0.0"},
+		{RepositoryPath: "example.org/c"},
+	}
+	wantReplacement := []Replace{
+		{From: "example.org/b", To: "example.org/fork", ToVersion: "v1.0.1"},
+		{From: "example.org/c", To: "../c"},
+	}
+	if !slices.Equal(plugins, wantPlugins) {
+		t.Errorf("plugins = %v, want %v", plugins, wantPlugins)
+	}
+	if !slices.Equal(replacement, wantReplacement) {
+		t.Errorf("replacements = %v, want %v", replacement, wantReplacement)
+	}
+}
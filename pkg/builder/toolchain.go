@@ -0,0 +1,162 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"go/version"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cs3org/gaia/internal/utils"
+)
+
+// ParseGoVersion checks the go version, with
+// or without the go prefix, and returns it without.
+func ParseGoVersion(v string) (string, error) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "go")
+	if !version.IsValid("go" + v) {
+		return "", fmt.Errorf("invalid go version %q, expected e.g. 1.22.5", v)
+	}
+	return v, nil
+}
+
+// DefaultToolchainDir returns the directory where golang.org/dl
+// installs the go toolchains, as go<version>.
+func DefaultToolchainDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, "sdk")
+}
+
+// toolchain is the go toolchain running the go commands of a workspace.
+type toolchain struct {
+	gobin string // go command
+	// env sets GOTOOLCHAIN, so that the go.mod of
+	// a dependency never switches to another toolchain
+	env     string
+	version string
+}
+
+// findToolchain returns the toolchain of the requested go version,
+// the installed one if empty. A pinned version is looked for, in order,
+// as the installed toolchain, in the toolchain directory and in the
+// module cache, and otherwise downloaded by the go command, unless
+// offline.
+func (b *Builder) findToolchain(goenv []string, host Platform) (*toolchain, error) {
+	if b.GoVersion == "" {
+		v, err := goVersionOf(utils.Go(), nil)
+		if err != nil {
+			return nil, err
+		}
+		t := &toolchain{gobin: utils.Go(), version: v}
+		if b.Reproducible {
+			t.env = "GOTOOLCHAIN=local"
+		}
+		return t, nil
+	}
+
+	want, err := ParseGoVersion(b.GoVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &toolchain{env: "GOTOOLCHAIN=local"}
+	if v, err := goVersionOf(utils.Go(), append(os.Environ(), t.env)); err == nil && v == want {
+		t.gobin = utils.Go()
+	}
+	dir := b.ToolchainDir
+	if dir == "" {
+		dir = DefaultToolchainDir()
+	}
+	var candidates []string
+	if dir != "" {
+		// the go commands are run from the workspace
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		candidates = append(candidates, filepath.Join(dir, "go"+want, "bin", "go"))
+	}
+	if modcache := envValue(goenv, "GOMODCACHE"); modcache != "" {
+		mod := fmt.Sprintf("toolchain@v0.0.1-go%s.%s-%s", want, host.OS, host.Arch)
+		candidates = append(candidates, filepath.Join(modcache, "golang.org", mod, "bin", "go"))
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil && t.gobin == "" {
+			t.gobin = c
+		}
+	}
+	if t.gobin == "" {
+		if b.Offline {
+			return nil, fmt.Errorf("%w: go %s is not installed, neither in %s nor in the module cache, and cannot be downloaded offline", ErrToolchainNotFound, want, dir)
+		}
+		// the go command downloads it into the module cache
+		b.Log.Info().Msgf("go %s not found locally, downloading it", want)
+		t.gobin = utils.Go()
+		t.env = "GOTOOLCHAIN=go" + want
+	}
+
+	t.version, err = goVersionOf(t.gobin, append(slices.Clone(goenv), t.env))
+	if err != nil {
+		return nil, err
+	}
+	if t.version != want {
+		return nil, &ToolchainMismatchError{Want: want, Got: t.version, Go: t.gobin}
+	}
+	return t, nil
+}
+
+// goVersionOf returns the version reported by the go command,
+// run in the given environment, or the current one if nil.
+func goVersionOf(gobin string, env []string) (string, error) {
+	var b, stderr strings.Builder
+	cmd := exec.Command(gobin, "version")
+	cmd.Stdout = &b
+	cmd.Stderr = &stderr
+	if env != nil {
+		cmd.Env = append(env, "PATH="+fromEnv("PATH"))
+	}
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		return "", fmt.Errorf("%w: %w", ErrToolchainNotFound, err)
+	}
+	s := strings.Split(b.String(), " ")
+	if len(s) < 3 {
+		return "", fmt.Errorf("unexpected output of go version: %s", b.String())
+	}
+	return strings.TrimPrefix(s[2], "go"), nil
+}
+
+// envValue returns the value of the variable in the environment.
+func envValue(env []string, key string) string {
+	for _, e := range env {
+		if k, v, ok := strings.Cut(e, "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
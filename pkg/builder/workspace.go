@@ -19,12 +19,16 @@
 package builder
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/cs3org/gaia/internal/utils"
@@ -32,10 +36,16 @@ import (
 )
 
 type workspace struct {
-	folder string   // temp directory where all the ops are executed
-	goenv  []string // environment used for go commands
-	log    *zerolog.Logger
-	leave  bool
+	folder  string   // temp directory where all the ops are executed
+	goenv   []string // environment used for go commands
+	plugins []Plugin // plugins of the build, to attribute the failures
+	reva    string   // module path of reva
+	host    Platform // platform of the go toolchain
+	gobin   string   // go command
+	goVer   string   // version of the go toolchain
+	events  EventSink
+	log     *zerolog.Logger
+	leave   bool
 }
 
 func (b *Builder) newWorkspace() (*workspace, error) {
@@ -44,14 +54,51 @@ func (b *Builder) newWorkspace() (*workspace, error) {
 		return nil, fmt.Errorf("error creating temp directory: %w", err)
 	}
 	b.Log.Info().Msgf("using temp folder %s as workspace", tmpFolder)
+	env, err := utils.FromGoEnv(goEnvKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrToolchainNotFound, err)
+	}
+	var host Platform
+	if host.OS, err = utils.KeyFromGoEnv("GOHOSTOS"); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrToolchainNotFound, err)
+	}
+	if host.Arch, err = utils.KeyFromGoEnv("GOHOSTARCH"); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrToolchainNotFound, err)
+	}
+	tc, err := b.findToolchain(env, host)
+	if err != nil {
+		return nil, err
+	}
+	if tc.env != "" {
+		env = append(env, tc.env)
+	}
 	w := &workspace{
-		folder: tmpFolder,
-		log:    b.Log,
-		leave:  b.LeaveWorkspace,
+		folder:  tmpFolder,
+		goenv:   env,
+		host:    host,
+		gobin:   tc.gobin,
+		goVer:   tc.version,
+		events:  b.Events,
+		plugins: b.Plugins,
+		reva:    b.revaModule(),
+		log:     b.Log,
+		leave:   b.LeaveWorkspace,
 	}
 	return w, nil
 }
 
+// goEnvKeys are the variables of the go environment
+// inherited by the go commands run in the workspace.
+var goEnvKeys = []string{"GOPATH", "GOMODCACHE", "GOCACHE", "CGO_ENABLED", "GOPROXY"}
+
+// clone returns a copy of the workspace, sharing the same folder,
+// whose environment can be changed independently.
+func (w *workspace) clone() *workspace {
+	c := *w
+	c.goenv = slices.Clone(w.goenv)
+	return &c
+}
+
 func (w *workspace) setLeave(leave bool) {
 	w.leave = leave
 }
@@ -67,8 +114,8 @@ func (w *workspace) setEnv(env string) {
 	}
 
 	key := es[0]
-	for i, env := range w.goenv {
-		s := strings.SplitN(env, "=", 2)
+	for i, e := range w.goenv {
+		s := strings.SplitN(e, "=", 2)
 		if key == s[0] {
 			w.goenv[i] = env
 			return
@@ -97,20 +144,91 @@ func (w workspace) newCommand(ctx context.Context, cmd string, stderr io.Writer,
 
 func (w workspace) runGoCommand(ctx context.Context, args ...string) error {
 	var buf strings.Builder
-	cmd := w.newGoCommand(ctx, &buf, args...)
+	stderr, flush := w.goCommandStderr(ctx, &buf)
+	cmd := w.newGoCommand(ctx, stderr, args...)
 	w.log.Debug().Str("cmd", cmd.String()).Strs("env", cmd.Env).Send()
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%w: %s", err, strings.TrimSpace(buf.String()))
+	err := cmd.Run()
+	flush()
+	if err != nil {
+		return w.newCommandError(ctx, args, buf.String(), err)
 	}
 	return nil
 }
 
+func (w workspace) newCommandError(ctx context.Context, args []string, stderr string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		err = fmt.Errorf("%w: %w", ErrToolchainNotFound, err)
+	}
+	stderr = strings.TrimSpace(stderr)
+	diags := ParseGoOutput(stderr, w.plugins)
+	// the dependencies of the plugins are found in the module graph,
+	// unless it is the command failing
+	unattributed := slices.ContainsFunc(diags, func(d Diagnostic) bool { return d.Plugin == "" })
+	if unattributed && !slices.Equal(args, []string{"mod", "graph"}) {
+		if graph, err := w.moduleGraph(ctx); err == nil {
+			diags = attributeDependencies(diags, graph, w.plugins)
+		}
+	}
+	return &CommandError{
+		Args:        args,
+		Stderr:      stderr,
+		Err:         err,
+		Diagnostics: diags,
+	}
+}
+
+// outputGoCommand runs the go command and returns its standard output,
+// also when the command fails, as some commands report errors there.
+func (w workspace) outputGoCommand(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	var buf strings.Builder
+	stderr, flush := w.goCommandStderr(ctx, &buf)
+	cmd := w.newGoCommand(ctx, stderr, args...)
+	cmd.Stdout = &stdout
+	w.log.Debug().Str("cmd", cmd.String()).Strs("env", cmd.Env).Send()
+	err := cmd.Run()
+	flush()
+	if err != nil {
+		return stdout.Bytes(), w.newCommandError(ctx, args, buf.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// listModules returns all the modules in the build list
+// of the workspace, excluding the main module.
+func (w workspace) listModules(ctx context.Context) ([]Module, error) {
+	// the build list cannot be computed in vendor mode,
+	// the default once the workspace is vendored
+	out, err := w.outputGoCommand(ctx, "list", "-mod=readonly", "-m", "-json", "all")
+	if err != nil {
+		return nil, err
+	}
+	var modules []Module
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m Module
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error decoding module list: %w", err)
+		}
+		if m.Main {
+			continue
+		}
+		modules = append(modules, m)
+	}
+	return modules, nil
+}
+
 func (w workspace) runGoGetCommand(ctx context.Context, repositoryPath, version string) error {
 	get := repositoryPath
 	if version != "" {
 		get += "@" + version
 	}
-	return w.runGoCommand(ctx, "get", get)
+	if err := w.runGoCommand(ctx, "get", get); err != nil {
+		return &ModuleFetchError{Module: repositoryPath, Version: version, Err: err}
+	}
+	return nil
 }
 
 func (w workspace) runGoBuildCommand(ctx context.Context, src, output string, args ...string) error {
@@ -130,11 +248,8 @@ func (w workspace) runGoModReplaceCommand(ctx context.Context, replacement []Rep
 }
 
 func (w workspace) newGoCommand(ctx context.Context, stderr io.Writer, args ...string) *exec.Cmd {
-	c := w.newCommand(ctx, utils.Go(), stderr, args...)
-	for _, env := range utils.FromGoEnv("GOPATH", "GOMODCACHE", "GOCACHE", "CGO_ENABLED", "GOPROXY") {
-		w.setEnv(env)
-	}
-	c.Env = w.goenv
+	c := w.newCommand(ctx, w.gobin, stderr, args...)
+	c.Env = slices.Clone(w.goenv)
 	pathEnv := fmt.Sprintf("PATH=%s", fromEnv("PATH"))
 	c.Env = append(c.Env, pathEnv)
 	return c
@@ -19,6 +19,7 @@
 package service
 
 import (
+	"crypto/ed25519"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -27,6 +28,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/cs3org/gaia/pkg/builder"
 	"github.com/cs3org/gaia/service/internal/crud"
 	"github.com/cs3org/gaia/service/internal/model/registry"
 	"github.com/rs/zerolog"
@@ -40,6 +42,8 @@ type Builder struct {
 	c           *Config
 	reg         *registry.Registry
 	staticFiles fs.FS
+	signKey     ed25519.PrivateKey
+	artifacts   artifacts
 }
 
 type Config struct {
@@ -47,6 +51,10 @@ type Config struct {
 	BinaryTempFolder string          `mapstructure:"binary_temp_folder"`
 	BuildTimeout     time.Duration   `mapstructure:"build_timeout"`
 	DBFile           string          `mapstructure:"db_file"`
+	Offline          bool            `mapstructure:"offline"`
+	BuilderID        string          `mapstructure:"builder_id"`
+	SignKey          string          `mapstructure:"sign_key"`
+	ArtifactTTL      time.Duration   `mapstructure:"artifact_ttl"`
 	Log              *zerolog.Logger `mapstructure:"-"`
 	registry.Config  `mapstructure:",squash"`
 
@@ -62,6 +70,10 @@ func (c *Config) ApplyDefaults() {
 		c.BuildTimeout = 120 * time.Second
 	}
 
+	if c.ArtifactTTL == 0 {
+		c.ArtifactTTL = 10 * time.Minute
+	}
+
 	if c.DBFile == "" {
 		tmp, err := os.CreateTemp("", "*")
 		if err != nil {
@@ -94,6 +106,13 @@ func New(c *Config) (*Builder, error) {
 		c:           c,
 		staticFiles: staticFiles,
 		reg:         registry,
+		artifacts:   artifacts{ttl: c.ArtifactTTL},
+	}
+	if c.SignKey != "" {
+		b.signKey, err = builder.ReadPrivateKey(c.SignKey)
+		if err != nil {
+			return nil, err
+		}
 	}
 	b.initRouter()
 	return &b, nil
@@ -113,6 +132,17 @@ func (s *Builder) initRouter() {
 		}
 	})
 
+	mux.HandleFunc("/artifacts/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.downloadArtifact(w, r)
+			return
+		default:
+			methodNotAllowed(w)
+			return
+		}
+	})
+
 	mux.HandleFunc("/plugins", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
@@ -124,6 +154,17 @@ func (s *Builder) initRouter() {
 		}
 	})
 
+	mux.HandleFunc("/signing-key", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.signingKey(w, r)
+			return
+		default:
+			methodNotAllowed(w)
+			return
+		}
+	})
+
 	mux.HandleFunc("/", s.serveStatic)
 
 	s.router = RecoverFromPanicMiddleware(s.c.Log, RequestLoggerMiddleware(s.c.Log, mux))
@@ -180,6 +221,22 @@ func (s *Builder) listPlugins(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// signingKey sends back the public key the downloaded
+// binaries can be verified with, if they are signed.
+func (s *Builder) signingKey(w http.ResponseWriter, r *http.Request) {
+	if s.signKey == nil {
+		writeError(errors.New("the binaries are not signed"), http.StatusNotFound, w)
+		return
+	}
+	pub, err := builder.MarshalPublicKey(s.signKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		writeError(err, http.StatusInternalServerError, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(pub)
+}
+
 func (s *Builder) serveStatic(w http.ResponseWriter, r *http.Request) {
 	fs := http.FileServer(http.FS(s.staticFiles))
 	fs.ServeHTTP(w, r)
@@ -19,12 +19,17 @@
 package service
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -32,11 +37,31 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// headers of the checksum and of the base64 encoded signature
+// of the binary, when sent back alone and signed
+const (
+	checksumHeader  = "X-Gaia-Sha256"
+	signatureHeader = "X-Gaia-Signature"
+)
+
 type downloadRequest struct {
 	OS          string
 	Arch        string
 	RevaVersion string
 	Plugins     []string
+	SBOM        bool
+	Provenance  bool
+	Events      bool
+}
+
+// artifact is the outcome of a build, sent back to the client:
+// the binary together with its attachments, if any.
+type artifact struct {
+	dir         string // folder of the binary, removed once sent
+	name        string
+	binary      string
+	attachments map[string][]byte
+	header      http.Header
 }
 
 func (s *Builder) download(w http.ResponseWriter, r *http.Request) {
@@ -65,6 +90,25 @@ func (s *Builder) download(w http.ResponseWriter, r *http.Request) {
 		Interface("plugins", plugins).
 		Msg("request build of reva")
 
+	if req.Events {
+		s.streamBuild(w, r, req, plugins)
+		return
+	}
+
+	a, err := s.runBuild(ctx, req, plugins, nil)
+	if err != nil {
+		writeBuildError(err, w)
+		return
+	}
+	defer a.remove()
+	a.send(ctx, w)
+}
+
+// runBuild builds reva with the plugins, sending the events
+// of the build to the sink if not nil.
+func (s *Builder) runBuild(ctx context.Context, req *downloadRequest, plugins []builder.Plugin, events builder.EventSink) (*artifact, error) {
+	log := zerolog.Ctx(ctx)
+
 	b := builder.Builder{
 		Platform: builder.Platform{
 			OS:   req.OS,
@@ -74,29 +118,44 @@ func (s *Builder) download(w http.ResponseWriter, r *http.Request) {
 		Log:         log,
 		Plugins:     plugins,
 		TempFolder:  s.c.BuildFolder,
+		Offline:     s.c.Offline,
+		Provenance:  req.Provenance,
+		BuilderID:   s.c.BuilderID,
+		SignKey:     s.signKey,
+		Events:      events,
 	}
 	defer b.Close()
 
-	output, err := os.CreateTemp(s.c.BinaryTempFolder, "revad")
+	// the binary is built in its own folder, with the name
+	// it is sent back with, together with its attachments
+	a := &artifact{
+		name:        binaryRevadName(req.OS, req.Arch, req.RevaVersion),
+		attachments: make(map[string][]byte),
+		header:      make(http.Header),
+	}
+	var err error
+	a.dir, err = os.MkdirTemp(s.c.BinaryTempFolder, "revad-*")
 	if err != nil {
-		log.Error().Err(err).Msg("error creating temp file for revad")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Error().Err(err).Msg("error creating temp folder for revad")
+		return nil, err
 	}
-	defer output.Close()
-	defer os.RemoveAll(output.Name())
+	output := filepath.Join(a.dir, a.name)
+	a.binary = output
+	defer func() {
+		if err != nil {
+			a.remove()
+		}
+	}()
 
 	buildCtx, cancel := context.WithTimeout(ctx, s.c.BuildTimeout)
 	defer cancel()
-	if err := b.Prepare(buildCtx); err != nil {
+	if err = b.Prepare(buildCtx); err != nil {
 		log.Error().Err(err).Msg("error preparing build")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	if err := b.Build(buildCtx, output.Name()); err != nil {
+	if err = b.Build(buildCtx, output); err != nil {
 		log.Error().Err(err).Msg("error building reva")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// update download counter for the chosen plugins
@@ -106,7 +165,143 @@ func (s *Builder) download(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	sendBinary(ctx, w, binaryRevadName(req.OS, req.Arch, req.RevaVersion), output.Name())
+	if req.SBOM {
+		var sbom bytes.Buffer
+		if err = b.WriteSBOM(ctx, &sbom); err != nil {
+			log.Error().Err(err).Msg("error generating SBOM")
+			return nil, err
+		}
+		a.attachments[a.name+".cdx.json"] = sbom.Bytes()
+	}
+	if req.Provenance {
+		var provenance []byte
+		if provenance, err = os.ReadFile(builder.ProvenancePath(output)); err != nil {
+			log.Error().Err(err).Msg("error reading provenance")
+			return nil, err
+		}
+		a.attachments[filepath.Base(builder.ProvenancePath(output))] = provenance
+	}
+
+	if s.signKey != nil {
+		var checksum, signature []byte
+		if checksum, err = os.ReadFile(builder.ChecksumPath(output)); err == nil {
+			signature, err = os.ReadFile(builder.SignaturePath(output))
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("error reading signature")
+			return nil, err
+		}
+		if len(a.attachments) == 0 {
+			// the binary alone carries its signature in the headers
+			sum, _, _ := strings.Cut(string(checksum), " ")
+			a.header.Set(checksumHeader, sum)
+			a.header.Set(signatureHeader, base64.StdEncoding.EncodeToString(signature))
+		} else {
+			a.attachments[filepath.Base(builder.ChecksumPath(output))] = checksum
+			a.attachments[filepath.Base(builder.SignaturePath(output))] = signature
+		}
+	}
+	return a, nil
+}
+
+// send sends back the binary alone, or in a zip
+// archive together with its attachments.
+func (a *artifact) send(ctx context.Context, w http.ResponseWriter) {
+	for k, v := range a.header {
+		w.Header()[k] = v
+	}
+	if len(a.attachments) == 0 {
+		sendBinary(ctx, w, a.name, a.binary)
+		return
+	}
+	sendArchive(ctx, w, a.name, a.binary, a.attachments)
+}
+
+func (a *artifact) remove() {
+	_ = os.RemoveAll(a.dir)
+}
+
+// sendArchive sends back a zip archive containing the
+// binary together with the given additional files.
+func sendArchive(ctx context.Context, w http.ResponseWriter, name, binary string, files map[string][]byte) {
+	log := zerolog.Ctx(ctx)
+
+	file, err := os.Open(binary)
+	if err != nil {
+		log.Error().Err(err).Msgf("error opening file %s", binary)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", name))
+
+	z := zip.NewWriter(w)
+	f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, ExternalAttrs: 0755 << 16})
+	if err != nil {
+		log.Error().Err(err).Msg("error creating archive")
+		return
+	}
+	if _, err := io.Copy(f, file); err != nil {
+		log.Error().Err(err).Msg("error sending back reva binary")
+		return
+	}
+	for n, content := range files {
+		f, err := z.Create(n)
+		if err != nil {
+			log.Error().Err(err).Msg("error creating archive")
+			return
+		}
+		if _, err := f.Write(content); err != nil {
+			log.Error().Err(err).Msgf("error sending back %s", n)
+			return
+		}
+	}
+	if err := z.Close(); err != nil {
+		log.Error().Err(err).Msg("error closing archive")
+	}
+}
+
+type buildErrorRes struct {
+	Error       string               `json:"error"`
+	Diagnostics []builder.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// writeBuildError sends back the error of a failed build,
+// together with the diagnostics of the go toolchain.
+func writeBuildError(err error, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(buildErrorStatus(err))
+	_ = json.NewEncoder(w).Encode(buildErrorRes{
+		Error:       err.Error(),
+		Diagnostics: builder.Diagnostics(err),
+	})
+}
+
+// buildErrorStatus maps an error returned by the builder
+// to the HTTP status sent back to the client.
+func buildErrorStatus(err error) int {
+	var (
+		fetchErr   *builder.ModuleFetchError
+		compileErr *builder.CompileError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, builder.ErrToolchainNotFound):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, builder.ErrIncompatiblePlugins), errors.Is(err, builder.ErrLockDrift):
+		return http.StatusConflict
+	case errors.Is(err, builder.ErrVersionNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &fetchErr):
+		return http.StatusBadGateway
+	case errors.As(err, &compileErr):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
 func sendBinary(ctx context.Context, w http.ResponseWriter, name, binary string) {
@@ -159,9 +354,30 @@ func parseDownloadRequest(r *http.Request) (*downloadRequest, error) {
 	// this can be emtpy, in this case the builder
 	// will only build reva without plugins
 	req.Plugins = q["plugin"]
+	// when asked, the SBOM and the provenance are sent
+	// back together with the binary in a zip archive
+	var err error
+	if req.SBOM, err = parseBoolParam(q.Get("sbom")); err != nil {
+		return nil, fmt.Errorf("invalid value for sbom: %w", err)
+	}
+	if req.Provenance, err = parseBoolParam(q.Get("provenance")); err != nil {
+		return nil, fmt.Errorf("invalid value for provenance: %w", err)
+	}
+	// when asked, the events of the build are streamed back,
+	// and the result is then downloaded from /artifacts
+	if req.Events, err = parseBoolParam(q.Get("events")); err != nil {
+		return nil, fmt.Errorf("invalid value for events: %w", err)
+	}
 	return &req, nil
 }
 
+func parseBoolParam(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
 func parsePlugins(plugins []string) ([]builder.Plugin, error) {
 	p := make([]builder.Plugin, 0, len(plugins))
 	for _, plugin := range plugins {
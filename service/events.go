@@ -0,0 +1,146 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cs3org/gaia/pkg/builder"
+	"github.com/rs/zerolog"
+)
+
+// artifacts holds the results of the streamed builds
+// until they are downloaded, or expire.
+type artifacts struct {
+	mu  sync.Mutex
+	m   map[string]*artifact
+	ttl time.Duration
+}
+
+// add stores the artifact, returning the token it can be
+// downloaded with. It is removed if not downloaded in time.
+func (s *artifacts) add(a *artifact) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]*artifact)
+	}
+	s.m[token] = a
+	time.AfterFunc(s.ttl, func() {
+		if a := s.take(token); a != nil {
+			a.remove()
+		}
+	})
+	return token, nil
+}
+
+// take removes the artifact from the store, returning nil if not found.
+func (s *artifacts) take(token string) *artifact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.m[token]
+	delete(s.m, token)
+	return a
+}
+
+type artifactRes struct {
+	URL  string `json:"url"`
+	Name string `json:"name"`
+}
+
+// streamBuild sends back the events of the build as server-sent
+// events, ending with a done event giving the URL the result can be
+// downloaded from, once, or with an error event.
+func (s *Builder) streamBuild(w http.ResponseWriter, r *http.Request, req *downloadRequest, plugins []builder.Plugin) {
+	ctx := r.Context()
+	log := zerolog.Ctx(ctx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(errors.New("streaming not supported"), http.StatusInternalServerError, w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// the platforms are built in parallel
+	var mu sync.Mutex
+	send := func(event string, v any) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Error().Err(err).Msgf("error encoding %s event", event)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+
+	a, err := s.runBuild(ctx, req, plugins, builder.EventSinkFunc(func(e builder.Event) {
+		send(string(e.Type), e)
+	}))
+	if err != nil {
+		send("error", buildErrorRes{
+			Error:       err.Error(),
+			Diagnostics: builder.Diagnostics(err),
+		})
+		return
+	}
+	token, err := s.artifacts.add(a)
+	if err != nil {
+		a.remove()
+		log.Error().Err(err).Msg("error storing the artifact")
+		send("error", buildErrorRes{Error: err.Error()})
+		return
+	}
+	name := a.name
+	if len(a.attachments) != 0 {
+		name += ".zip"
+	}
+	send("done", artifactRes{URL: "/artifacts/" + token, Name: name})
+}
+
+// downloadArtifact sends back the result of a streamed build.
+func (s *Builder) downloadArtifact(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/artifacts/")
+	a := s.artifacts.take(token)
+	if a == nil {
+		writeError(errors.New("artifact not found or expired"), http.StatusNotFound, w)
+		return
+	}
+	defer a.remove()
+	a.send(r.Context(), w)
+}